@@ -0,0 +1,209 @@
+package vedirect
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Capture format, written for Options.Capture and read by CaptureReader.
+//
+// A header line, then one line per chunk of bytes as it was read from or written to the device:
+//
+//	# vedirect capture v1
+//	{unix milliseconds} < "{received bytes, Go quoted}"
+//	{unix milliseconds} > "{sent bytes, Go quoted}"
+//	# {unix milliseconds} {comment, e.g. connection lost}
+//
+// Captures are text so they can be attached to bug reports and read by eye.
+// OpenWithOptions reads a capture file as the received bytes, with Options.Replay at the recorded pace.
+const captureHeader = "# vedirect capture v1\n"
+
+var ErrNotCapture = errors.New("not a vedirect capture")
+
+// CaptureChunk is one line of a capture
+type CaptureChunk struct {
+	Time time.Time
+
+	// Sent is true for bytes written to the device, false for bytes received
+	Sent bool
+
+	Data []byte
+}
+
+// captureWriter writes capture lines for Options.Capture
+type captureWriter struct {
+	l sync.Mutex
+	w io.Writer
+
+	// first error, stops capture
+	err error
+}
+
+func newCaptureWriter(w io.Writer) *captureWriter {
+	cw := &captureWriter{w: w}
+	_, cw.err = io.WriteString(w, captureHeader)
+	return cw
+}
+
+func (cw *captureWriter) chunk(sent bool, b []byte) {
+	dir := '<'
+	if sent {
+		dir = '>'
+	}
+	cw.printf("%d %c %s\n", time.Now().UnixMilli(), dir, strconv.Quote(string(b)))
+}
+
+func (cw *captureWriter) comment(msg string, args ...interface{}) {
+	cw.printf("# %d %s\n", time.Now().UnixMilli(), fmt.Sprintf(msg, args...))
+}
+
+func (cw *captureWriter) printf(format string, args ...interface{}) {
+	cw.l.Lock()
+	defer cw.l.Unlock()
+	if cw.err != nil {
+		return
+	}
+	_, cw.err = fmt.Fprintf(cw.w, format, args...)
+}
+
+// CaptureReader reads a capture written for Options.Capture.
+//
+// As an io.Reader it returns only the received bytes, so it can be given to NewReader.
+type CaptureReader struct {
+	br *bufio.Reader
+	r  io.Reader
+
+	// received bytes not yet returned by Read
+	pending []byte
+
+	// time of the chunk Read is returning
+	t time.Time
+}
+
+// NewCaptureReader checks the capture header, ErrNotCapture if it isn't one.
+// If r is an io.Closer, Close closes it.
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	line, err := br.ReadString('\n')
+	if line != captureHeader {
+		if err == nil || err == io.EOF {
+			err = ErrNotCapture
+		}
+		return nil, err
+	}
+	return &CaptureReader{br: br, r: r}, nil
+}
+
+// starts with captureHeader
+func isCaptureFormat(br *bufio.Reader) bool {
+	peek, _ := br.Peek(len(captureHeader))
+	return string(peek) == captureHeader
+}
+
+// Next returns the next chunk, sent or received. io.EOF at the end.
+func (cr *CaptureReader) Next() (chunk CaptureChunk, err error) {
+	for {
+		var line string
+		line, err = cr.br.ReadString('\n')
+		if err == io.EOF && len(line) != 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		ts, rest, _ := strings.Cut(line, " ")
+		dir, quoted, _ := strings.Cut(rest, " ")
+		var ms int64
+		ms, err = strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			err = fmt.Errorf("capture bad time %#v, %w", ts, err)
+			return
+		}
+		var data string
+		data, err = strconv.Unquote(quoted)
+		if err != nil {
+			err = fmt.Errorf("capture bad data %.20s, %w", quoted, err)
+			return
+		}
+		switch dir {
+		case "<":
+		case ">":
+			chunk.Sent = true
+		default:
+			err = fmt.Errorf("capture bad direction %#v", dir)
+			return
+		}
+		chunk.Time = time.UnixMilli(ms)
+		chunk.Data = []byte(data)
+		return
+	}
+}
+
+// Read received bytes, at most one chunk per call
+func (cr *CaptureReader) Read(p []byte) (int, error) {
+	for len(cr.pending) == 0 {
+		chunk, err := cr.Next()
+		if err != nil {
+			return 0, err
+		}
+		if chunk.Sent {
+			continue
+		}
+		cr.pending = chunk.Data
+		cr.t = chunk.Time
+	}
+	n := copy(p, cr.pending)
+	cr.pending = cr.pending[n:]
+	return n, nil
+}
+
+// Time the bytes from the last Read were received
+func (cr *CaptureReader) Time() time.Time {
+	return cr.t
+}
+
+func (cr *CaptureReader) Close() error {
+	rc, ok := cr.r.(io.Closer)
+	if ok {
+		return rc.Close()
+	}
+	return nil
+}
+
+// captureFile is a regular file opened by OpenWithOptions, buffered so that its format can be checked
+type captureFile struct {
+	*bufio.Reader
+	f *os.File
+}
+
+func (cf *captureFile) Close() error {
+	return cf.f.Close()
+}
+
+// openCaptureFile reads a capture written for Options.Capture, or raw serial data (or JSON records, see ReplayOptions)
+func openCaptureFile(f *os.File) (io.ReadWriter, error) {
+	cf := &captureFile{bufio.NewReader(f), f}
+	if !isCaptureFormat(cf.Reader) {
+		return readOnly{cf}, nil
+	}
+	cr, err := NewCaptureReader(cf)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return readOnly{cr}, nil
+}
@@ -0,0 +1,98 @@
+package vedirect
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCapture(t *testing.T) {
+	var stream []byte
+	stream = append(stream, testFrame("PID", "0xA053", "V", "13820")...)
+	bad := testFrame("PID", "0xA053", "V", "13830")
+	bad[len(bad)-1]++
+	stream = append(stream, bad...)
+	stream = append(stream, testFrame("PID", "0xA053", "V", "13840")...)
+	var capture bytes.Buffer
+	out := make(chan map[string]string, 10)
+	v := New(&testRW{Reader: bytes.NewReader(stream)}, out, Options{Capture: &capture})
+	err := v.SendHexCommand(Get, []byte{0xf0, 0xed, 0x00})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs := readAll(out)
+	eq(t, 2, len(recs))
+
+	eq(t, true, strings.HasPrefix(capture.String(), captureHeader))
+	cr, err := NewCaptureReader(bytes.NewReader(capture.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received, sent []byte
+	for {
+		chunk, err := cr.Next()
+		if err != nil {
+			break
+		}
+		if time.Since(chunk.Time) > time.Minute {
+			t.Errorf("chunk time %s", chunk.Time)
+		}
+		if chunk.Sent {
+			sent = append(sent, chunk.Data...)
+		} else {
+			received = append(received, chunk.Data...)
+		}
+	}
+	eq(t, ":7F0ED0071\n", string(sent))
+	eq(t, string(stream), string(received))
+
+	// the capture file reads the same as the device did, bad frame included
+	path := writeTemp(t, capture.Bytes())
+	out = make(chan map[string]string, 10)
+	v, err = OpenWithOptions(path, out, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs = readAll(out)
+	eq(t, 2, len(recs))
+	eq(t, "13840", recs[1]["V"])
+	eq(t, int64(1), v.Stats().ChecksumErrors)
+
+	_, err = NewCaptureReader(bytes.NewReader(stream))
+	eq(t, ErrNotCapture, err)
+}
+
+func TestCaptureReplay(t *testing.T) {
+	chunk := func(ms int64, dir string, b []byte) string {
+		return fmt.Sprintf("%d %s %s\n", ms, dir, strconv.Quote(string(b)))
+	}
+	capture := captureHeader +
+		chunk(1665000000000, "<", testFrame("V", "12000")) +
+		chunk(1665000000500, ">", []byte(":154\n")) +
+		"# 1665000000600 a comment\n" +
+		chunk(1665000001000, "<", testFrame("V", "12010")) +
+		chunk(1665000002000, "<", testFrame("V", "12020"))
+	path := writeTemp(t, []byte(capture))
+	out := make(chan map[string]string, 10)
+	start := time.Now()
+	_, err := OpenWithOptions(path, out, Options{AddTime: true, Replay: &ReplayOptions{Speed: 20, KeepTime: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs := readAll(out)
+	elapsed := time.Since(start)
+	eq(t, 3, len(recs))
+	eq(t, "1665000002000", recs[2]["_t"])
+	if elapsed < 90*time.Millisecond {
+		t.Errorf("2s of capture at 20x took %s, wanted 100ms", elapsed)
+	}
+
+	// corrupt line
+	cr, _ := NewCaptureReader(strings.NewReader(captureHeader + "1665000000000 < nope\n"))
+	_, err = cr.Next()
+	eq(t, true, err != nil && !errors.Is(err, ErrNotCapture))
+}
@@ -9,10 +9,15 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
+	"text/tabwriter"
 
 	"github.com/brianolson/vedirect"
 )
@@ -27,17 +32,49 @@ func debug(msg string, args ...interface{}) {
 }
 
 func main() {
+	var replaySpeed float64
+	var keepTime bool
+	var capturePath string
+	var scan bool
 	flag.BoolVar(&verbose, "v", false, "verbose debug out")
+	flag.Float64Var(&replaySpeed, "replay", 0, "replay a capture file at this multiple of its recorded pace (e.g. 1, or 10 for ten times faster)")
+	flag.BoolVar(&keepTime, "keep-time", false, "with -replay, keep recorded _t times")
+	flag.StringVar(&capturePath, "capture", "", "append timestamped copy of all serial bytes to this file (readable as a device path)")
+	flag.BoolVar(&scan, "scan", false, "find VE.Direct devices on serial ports (or the glob patterns given as args) and print path, PID, model, serial and firmware")
 	flag.Parse()
 	argv := flag.Args()
+	var dout io.Writer
+	if verbose {
+		dout = os.Stderr
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if scan {
+		scanDevices(ctx, argv, dout)
+		return
+	}
+	if len(argv) != 1 {
+		fmt.Fprintf(os.Stderr, "usage: vedump [flags] device_path\n")
+		os.Exit(1)
+	}
 	fname := argv[0]
 	recChan := make(chan map[string]string, 10)
 	var wg sync.WaitGroup
-	dout := os.Stderr
-	if !verbose {
-		dout = nil
+	opts := vedirect.Options{
+		Debug:     dout,
+		WaitGroup: &wg,
+		Context:   ctx,
+	}
+	if replaySpeed > 0 {
+		opts.Replay = &vedirect.ReplayOptions{Speed: replaySpeed, KeepTime: keepTime}
+	}
+	if capturePath != "" {
+		capture, err := os.OpenFile(capturePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		maybefail(err, "%s: %v\n", capturePath, err)
+		defer capture.Close()
+		opts.Capture = capture
 	}
-	_, err := vedirect.Open(fname, recChan, &wg, context.Background(), dout)
+	vec, err := vedirect.OpenWithOptions(fname, recChan, opts)
 	maybefail(err, "%s: Vedirect Open, %v", fname, err)
 	for rec := range recChan {
 		blob, err := json.MarshalIndent(rec, "", "  ")
@@ -45,6 +82,29 @@ func main() {
 		fmt.Printf("%s\n", string(blob))
 	}
 	wg.Wait()
+	debug("%s: %+v", fname, vec.Stats())
+	err = vec.Err()
+	if !errors.Is(err, io.EOF) && !errors.Is(err, context.Canceled) {
+		maybefail(err, "%s: read, %v\n", fname, err)
+	}
+}
+
+func scanDevices(ctx context.Context, patterns []string, dout io.Writer) {
+	opts := vedirect.DiscoverOptions{Debug: dout}
+	if len(patterns) != 0 {
+		opts.Patterns = patterns
+	}
+	found, err := vedirect.Discover(ctx, opts)
+	maybefail(err, "scan: %v\n", err)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "path\tPID\tmodel\tserial\tfirmware\n")
+	for _, dev := range found {
+		fmt.Fprintf(tw, "%s\t0x%04X\t%s\t%s\t%s\n", dev.Path, uint16(dev.PID), dev.Model, dev.Serial, dev.Firmware)
+	}
+	tw.Flush()
+	if len(found) == 0 {
+		os.Exit(1)
+	}
 }
 
 func maybefail(err error, msg string, args ...interface{}) {
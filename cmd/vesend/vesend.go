@@ -7,12 +7,15 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/brianolson/vedirect"
@@ -41,6 +44,13 @@ var (
 	verbose      bool
 	sendJsonGzip bool
 	serveAddr    string
+	addLabels    bool
+	engineering  bool
+	reconnect    bool
+	mergeBlocks  bool
+	replaySpeed  float64
+	keepTime     bool
+	capturePath  string
 
 	temperaturePollPeriod time.Duration
 	battTempPollPeriod    time.Duration
@@ -56,6 +66,13 @@ func main() {
 	flag.BoolVar(&verbose, "v", false, "verbose debug out")
 	flag.BoolVar(&sendJsonGzip, "z", true, "sent application/gzip compress of json")
 	flag.StringVar(&serveAddr, "serve", "", "host:port to serve http API from")
+	flag.BoolVar(&reconnect, "reconnect", false, "reopen the device if it goes away (e.g. USB unplugged)")
+	flag.BoolVar(&mergeBlocks, "merge-blocks", false, "merge multi-block transmissions (BMV history) into one record")
+	flag.Float64Var(&replaySpeed, "replay", 0, "if -dev is a capture file, replay it at this multiple of its recorded pace")
+	flag.BoolVar(&keepTime, "keep-time", false, "with -replay, keep recorded _t times")
+	flag.StringVar(&capturePath, "capture", "", "append timestamped copy of all serial bytes to this file (readable as a -dev path)")
+	flag.BoolVar(&engineering, "eng", false, "with -serve, summarize HEX register values in engineering units (V, °C, ...) instead of raw register units")
+	flag.BoolVar(&addLabels, "labels", false, "add decoded {field}_label text for enumerated fields (CS, ERR, OR, ...)")
 	flag.Parse()
 	if postUrl == "" && serveAddr == "" {
 		fmt.Fprintf(os.Stderr, "one of '-post URL' or '-serve :port' is required\n")
@@ -68,27 +85,50 @@ func main() {
 		return
 	}
 	vedirect.DebugEnabled = verbose
-	dout := os.Stderr
-	if !verbose {
-		dout = nil
+	var dout io.Writer
+	if verbose {
+		dout = os.Stderr
 	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		debug("shutting down")
+		// a second signal kills immediately
+		stop()
+	}()
 	recChan := make(chan map[string]string, 10)
 	var wg sync.WaitGroup
-	vec, err := vedirect.Open(devicePath, recChan, &wg, context.Background(), dout, vedirect.AddTime)
+	opts := vedirect.Options{
+		AddTime:     true,
+		Debug:       dout,
+		WaitGroup:   &wg,
+		Context:     ctx,
+		Reconnect:   reconnect,
+		MergeBlocks: mergeBlocks,
+	}
+	if replaySpeed > 0 {
+		opts.Replay = &vedirect.ReplayOptions{Speed: replaySpeed, KeepTime: keepTime}
+	}
+	if capturePath != "" {
+		capture, err := os.OpenFile(capturePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		maybefail(err, "%s: %v", capturePath, err)
+		defer capture.Close()
+		opts.Capture = capture
+	}
+	vec, err := vedirect.OpenWithOptions(devicePath, recChan, opts)
 	maybefail(err, "%s: Open, %v", devicePath, err)
-	// TODO: add shutdown Context
 	wg.Add(1)
-	go mainThread(recChan, &wg)
+	go mainThread(recChan, vec, &wg)
 	if temperaturePollPeriod != 0 {
 		wg.Add(1)
-		go tpollThread(vec, temperaturePollPeriod, MPPT_TEMP_GET, &wg)
+		go tpollThread(ctx, vec, temperaturePollPeriod, MPPT_TEMP_GET, &wg)
 	}
 	if battTempPollPeriod != 0 {
 		wg.Add(1)
-		go tpollThread(vec, battTempPollPeriod, MPPT_BATT_TEMP_GET, &wg)
+		go tpollThread(ctx, vec, battTempPollPeriod, MPPT_BATT_TEMP_GET, &wg)
 	}
 	wg.Wait()
-
+	debug("%s: %v", devicePath, vec.Err())
 }
 
 type Server struct {
@@ -113,6 +153,9 @@ func (sums *Server) dataReceiver(recChan <-chan map[string]string, wg *sync.Wait
 
 type ReturnJSON struct {
 	Data []map[string]interface{} `json:"d"`
+
+	// Eng is true if HEX register values are in engineering units, see StreamingSummary.Engineering
+	Eng bool `json:"eng,omitempty"`
 }
 
 func (sums *Server) ServeHTTP(out http.ResponseWriter, req *http.Request) {
@@ -121,13 +164,35 @@ func (sums *Server) ServeHTTP(out http.ResponseWriter, req *http.Request) {
 	alldata := sums.sum.GetData(raw_after)
 	sums.l.RUnlock()
 	alldeltas := vedirect.ParsedRecordDeltas(alldata)
-	rdata := ReturnJSON{Data: alldeltas}
+	rdata := ReturnJSON{Data: alldeltas, Eng: sums.sum.Engineering}
 	out.Header().Set("Content-Type", "application/json")
 	out.WriteHeader(200)
 	enc := json.NewEncoder(out)
 	enc.Encode(rdata)
 }
 
+// serve parser Stats() and Err() for monitoring
+type statsHandler struct {
+	vec *vedirect.Vedirect
+}
+
+type statsJSON struct {
+	vedirect.Stats
+	Err string `json:"err,omitempty"`
+}
+
+func (sh *statsHandler) ServeHTTP(out http.ResponseWriter, req *http.Request) {
+	st := statsJSON{Stats: sh.vec.Stats()}
+	err := sh.vec.Err()
+	if err != nil {
+		st.Err = err.Error()
+	}
+	out.Header().Set("Content-Type", "application/json")
+	out.WriteHeader(200)
+	enc := json.NewEncoder(out)
+	enc.Encode(st)
+}
+
 type StaticHandler struct {
 	stripPrefix string
 	newPrefix   string
@@ -147,10 +212,8 @@ func (sh *StaticHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
-// TODO: catch shutdown signal and try to send immediately
-
 // receive data from Vedirect parser, sometimes poke the sendThread.
-func mainThread(recChan <-chan map[string]string, wg *sync.WaitGroup) {
+func mainThread(recChan <-chan map[string]string, vec *vedirect.Vedirect, wg *sync.WaitGroup) {
 	defer wg.Done()
 	batch := make([]map[string]string, 0, sendPeriod)
 	sendActive := false
@@ -165,8 +228,10 @@ func mainThread(recChan <-chan map[string]string, wg *sync.WaitGroup) {
 	defer close(reqStart)
 
 	var serv Server
+	serv.sum.Engineering = engineering
 	servChan := make(chan map[string]string, 10)
 	doServe := false
+	var httpServer *http.Server
 	if serveAddr != "" {
 		doServe = true
 		wg.Add(1)
@@ -174,20 +239,56 @@ func mainThread(recChan <-chan map[string]string, wg *sync.WaitGroup) {
 		mux := http.NewServeMux()
 		sh := StaticHandler{stripPrefix: "/s/", newPrefix: "/static/", fsHandler: http.FileServer(http.FS(veplot.VePlotStaticFS))}
 		mux.Handle("/s/", &sh)
+		mux.Handle("/stats.json", &statsHandler{vec})
 		mux.Handle("/", &serv)
-		httpServer := http.Server{
+		httpServer = &http.Server{
 			Addr:    serveAddr,
 			Handler: mux,
 		}
 		go httpServer.ListenAndServe()
 	}
 
+	// drop the front of batch that was successfully sent
+	sent := func(req sendRequest) {
+		debug("sent %d recs", len(req.msg.Data))
+		oldLast := len(req.msg.Data)
+		newLast := len(batch) - oldLast
+		copy(batch, batch[oldLast:])
+		batch = batch[:newLast]
+		sendActive = false
+	}
+
 	for {
 		select {
 		case rec, ok := <-recChan:
 			if !ok {
+				// shutdown: stop serving, try to send anything left once
+				debug("mainThread exiting")
 				close(servChan)
-				break
+				if httpServer != nil {
+					httpServer.Close()
+				}
+				if sendActive {
+					req := <-reqReturn
+					if req.err == nil {
+						sent(req)
+					}
+				}
+				if doPost && len(batch) > 0 {
+					debug("final send %d recs", len(batch))
+					msg := Message{
+						Data: vedirect.StringRecordDeltas(batch, nil, sendPeriod),
+					}
+					reqStart <- sendRequest{msg: &msg, start: time.Now()}
+					req := <-reqReturn
+					if req.err != nil {
+						log.Printf("final send failed, %d records lost: %v", len(batch), req.err)
+					}
+				}
+				return
+			}
+			if addLabels {
+				vedirect.AddStringRecordLabels(rec)
 			}
 			if doServe {
 				select {
@@ -214,13 +315,7 @@ func mainThread(recChan <-chan map[string]string, wg *sync.WaitGroup) {
 				break
 			}
 			if req.err == nil {
-				debug("sent %d recs", len(req.msg.Data))
-				// clear away batch data that was successfully sent
-				oldLast := len(req.msg.Data)
-				newLast := len(batch) - oldLast
-				copy(batch, batch[oldLast:])
-				batch = batch[:newLast]
-				sendActive = false
+				sent(req)
 			} else {
 				// grow the batch more, retry
 				debug("send err %v", req.err)
@@ -242,15 +337,25 @@ var MPPT_TEMP_GET []byte = []byte{0xDB, 0xED, 0x00}
 // returns uint16 0.01 deg K
 var MPPT_BATT_TEMP_GET []byte = []byte{0xEC, 0xED, 0x00}
 
-func tpollThread(vec *vedirect.Vedirect, period time.Duration, command []byte, wg *sync.WaitGroup) {
+func tpollThread(ctx context.Context, vec *vedirect.Vedirect, period time.Duration, command []byte, wg *sync.WaitGroup) {
 	if wg != nil {
 		defer wg.Done()
 	}
-	time.Sleep(time.Duration(rand.Int63n(period.Microseconds())) * time.Microsecond)
+	done := ctx.Done()
+	select {
+	case <-done:
+		return
+	case <-time.After(time.Duration(rand.Int63n(period.Microseconds())) * time.Microsecond):
+	}
 	temperaturePollTikcker := time.NewTicker(period)
 	defer temperaturePollTikcker.Stop()
-	for _ = range temperaturePollTikcker.C {
-		vec.SendHexCommand(vedirect.Get, command)
+	for {
+		select {
+		case <-done:
+			return
+		case <-temperaturePollTikcker.C:
+			vec.SendHexCommand(vedirect.Get, command)
+		}
 	}
 }
 
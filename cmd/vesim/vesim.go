@@ -0,0 +1,132 @@
+// vesim pretends to be a VE.Direct device
+//
+// It prints text protocol frames once per second and answers HEX
+// commands, on a pseudo-terminal (-pty), to TCP clients (-listen), or on
+// stdout/stdin.
+//
+//	vesim -pty -kind mppt -scenario sunrise -speed 60
+//	vedump /dev/pts/N
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/brianolson/vedirect/vesim"
+)
+
+var verbose bool
+
+func debug(msg string, args ...interface{}) {
+	if !verbose {
+		return
+	}
+	fmt.Fprintf(os.Stderr, msg+"\n", args...)
+}
+
+type stdio struct {
+	io.Reader
+	io.Writer
+}
+
+func main() {
+	var (
+		kindName     string
+		scenarioName string
+		speed        float64
+		interval     time.Duration
+		usePty       bool
+		listenAddr   string
+		serial       string
+	)
+	var scenarioNames []string
+	for name := range vesim.Scenarios {
+		scenarioNames = append(scenarioNames, name)
+	}
+	sort.Strings(scenarioNames)
+	flag.StringVar(&kindName, "kind", "mppt", "device to simulate: mppt, bmv, inverter")
+	flag.StringVar(&scenarioName, "scenario", "steady", "one of: "+strings.Join(scenarioNames, ", "))
+	flag.Float64Var(&speed, "speed", 1, "simulated time runs this many times faster")
+	flag.DurationVar(&interval, "interval", vesim.DefaultInterval, "time between text frames")
+	flag.BoolVar(&usePty, "pty", false, "serve on a new pseudo-terminal, path printed to stderr")
+	flag.StringVar(&listenAddr, "listen", "", "host:port to serve TCP clients, e.g. vedump tcp://host:port")
+	flag.StringVar(&serial, "serial", "", "serial number (SER#) to report")
+	flag.BoolVar(&verbose, "v", false, "verbose debug out")
+	flag.Parse()
+
+	kind, err := vesim.ParseKind(kindName)
+	maybefail(err, "-kind: %v\n", err)
+	scenario, ok := vesim.Scenarios[scenarioName]
+	if !ok {
+		maybefail(errors.New("bad scenario"), "-scenario: unknown %#v\n", scenarioName)
+	}
+	dev := vesim.NewDevice(kind)
+	dev.Scenario = scenario
+	dev.Speed = speed
+	dev.Interval = interval
+	if serial != "" {
+		dev.Serial = serial
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	switch {
+	case usePty:
+		pty, err := vesim.OpenPty()
+		maybefail(err, "pty: %v\n", err)
+		defer pty.Close()
+		fmt.Fprintf(os.Stderr, "%s %s on %s\n", kind, dev.PID, pty.Path)
+		err = dev.Run(ctx, pty)
+		done(err)
+	case listenAddr != "":
+		var lc net.ListenConfig
+		ln, err := lc.Listen(ctx, "tcp", listenAddr)
+		maybefail(err, "%s: %v\n", listenAddr, err)
+		go func() {
+			<-ctx.Done()
+			ln.Close()
+		}()
+		fmt.Fprintf(os.Stderr, "%s %s on tcp://%s\n", kind, dev.PID, ln.Addr())
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				done(ctx.Err())
+				maybefail(err, "accept: %v\n", err)
+			}
+			// one client at a time, the device has one serial port
+			debug("%s: connected", conn.RemoteAddr())
+			err = dev.Run(ctx, conn)
+			debug("%s: %v", conn.RemoteAddr(), err)
+			conn.Close()
+		}
+	default:
+		err = dev.Run(ctx, stdio{os.Stdin, os.Stdout})
+		done(err)
+	}
+}
+
+// exit quietly on signal
+func done(err error) {
+	if errors.Is(err, context.Canceled) {
+		os.Exit(0)
+	}
+	maybefail(err, "%v\n", err)
+}
+
+func maybefail(err error, msg string, args ...interface{}) {
+	if err == nil {
+		return
+	}
+	fmt.Fprintf(os.Stderr, msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,233 @@
+package vedirect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultDiscoverPatterns are globs of likely VE.Direct ports.
+// The stable /dev/serial/by-id names come first so they are reported instead of the ttyUSB they link to.
+var DefaultDiscoverPatterns = []string{
+	"/dev/serial/by-id/*VictronEnergy*",
+	"/dev/ttyUSB*",
+	"/dev/ttyACM*",
+}
+
+// DefaultDiscoverTimeout is how long to wait for a text frame, and then for HEX replies
+const DefaultDiscoverTimeout = 3 * time.Second
+
+var ErrNotIdentified = errors.New("no VE.Direct device identified")
+
+// DiscoverOptions for Discover and Identify
+type DiscoverOptions struct {
+	// Patterns are globs of candidate ports, default DefaultDiscoverPatterns
+	Patterns []string
+
+	// Timeout per port, default DefaultDiscoverTimeout
+	Timeout time.Duration
+
+	// Baud default DefaultBaud
+	Baud int
+
+	// Debug if not nil gets messages about each port tried
+	Debug io.Writer
+}
+
+// DiscoveredDevice is a device found by Discover
+type DiscoveredDevice struct {
+	Path   string
+	PID    ProductID
+	Model  string
+	Family ProductFamily
+
+	// Serial is "SER#", empty for devices that don't send one (BMV, SmartShunt)
+	Serial string
+
+	// Firmware e.g. "1.59"
+	Firmware string
+}
+
+func (do *DiscoverOptions) timeout() time.Duration {
+	if do.Timeout <= 0 {
+		return DefaultDiscoverTimeout
+	}
+	return do.Timeout
+}
+
+// Discover opens every port matching opts.Patterns and returns the devices identified, sorted by path.
+//
+// Ports are probed at the same time. Ports that can't be opened or don't identify as a VE.Direct device are skipped.
+// A port in use by another program may still open, and probing it takes some of that program's data.
+func Discover(ctx context.Context, opts DiscoverOptions) ([]DiscoveredDevice, error) {
+	paths, err := discoverPaths(opts.Patterns)
+	if err != nil {
+		return nil, err
+	}
+	dbg := Vedirect{dout: opts.Debug}
+	var wg sync.WaitGroup
+	var l sync.Mutex
+	var found []DiscoveredDevice
+	for _, path := range paths {
+		wg.Add(1)
+		go func(path string) {
+			defer wg.Done()
+			dev, err := Identify(ctx, path, opts)
+			if err != nil {
+				dbg.debug("%s: %v", path, err)
+				return
+			}
+			l.Lock()
+			found = append(found, dev)
+			l.Unlock()
+		}(path)
+	}
+	wg.Wait()
+	sort.Slice(found, func(i, j int) bool { return found[i].Path < found[j].Path })
+	return found, ctx.Err()
+}
+
+// glob patterns, skipping paths that are links to one already found
+func discoverPaths(patterns []string) ([]string, error) {
+	if patterns == nil {
+		patterns = DefaultDiscoverPatterns
+	}
+	seen := make(map[string]bool)
+	var paths []string
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range matches {
+			real, err := filepath.EvalSymlinks(path)
+			if err != nil {
+				real = path
+			}
+			if seen[real] {
+				continue
+			}
+			seen[real] = true
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+// Identify opens path and waits for a text frame with PID and firmware.
+// Devices that don't send text frames, or leave something out, are asked with HEX ProductId and Ping.
+func Identify(ctx context.Context, path string, opts DiscoverOptions) (dev DiscoveredDevice, err error) {
+	timeout := opts.timeout()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	out := make(chan map[string]string, 10)
+	v, err := OpenWithOptions(path, out, Options{
+		Baud:       opts.Baud,
+		Debug:      opts.Debug,
+		Context:    ctx,
+		HexTimeout: timeout / time.Duration(DefaultHexRetries+1),
+	})
+	if err != nil {
+		return
+	}
+	defer v.Close()
+	dev.Path = path
+	err = identify(ctx, v, out, &dev, timeout)
+	return
+}
+
+// identify reads out until v closes it, so the read thread never blocks on a full out and HEX replies still get through
+func identify(ctx context.Context, v *Vedirect, out <-chan map[string]string, dev *DiscoveredDevice, timeout time.Duration) error {
+	var fl sync.Mutex
+	fields := make(map[string]string)
+	changed := make(chan struct{}, 1)
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for rec := range out {
+			fl.Lock()
+			for k, fv := range rec {
+				fields[k] = fv
+			}
+			fl.Unlock()
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	field := func(k string) string {
+		fl.Lock()
+		defer fl.Unlock()
+		return fields[k]
+	}
+	textTimer := time.NewTimer(timeout)
+	defer textTimer.Stop()
+text:
+	for field("PID") == "" || (field("FW") == "" && field("FWE") == "") {
+		select {
+		case <-changed:
+		case <-closed:
+			break text
+		case <-textTimer.C:
+			break text
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	dev.Serial = field("SER#")
+	dev.Firmware = firmwareFromText(field("FW"), field("FWE"))
+	if pidText := field("PID"); pidText != "" {
+		pid, err := strconv.ParseUint(pidText, 0, 16)
+		if err != nil {
+			return fmt.Errorf("bad PID %#v", pidText)
+		}
+		dev.setProduct(ProductID(pid))
+	}
+	if dev.PID != 0 && dev.Firmware != "" {
+		return nil
+	}
+
+	hctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if dev.PID == 0 {
+		p, err := v.ProductID(hctx)
+		if err != nil {
+			return fmt.Errorf("%w, %v", ErrNotIdentified, err)
+		}
+		dev.setProduct(p.PID)
+	}
+	if dev.Firmware == "" {
+		fv, err := v.Ping(hctx)
+		if err == nil {
+			dev.Firmware = fv.String()
+		}
+	}
+	return nil
+}
+
+func (dev *DiscoveredDevice) setProduct(pid ProductID) {
+	p, _ := pid.Product()
+	dev.PID = pid
+	dev.Model = p.Name
+	dev.Family = p.Family
+}
+
+// text FW "159" or FWE "0159FF" is version 1.59
+func firmwareFromText(fw, fwe string) string {
+	if len(fwe) >= 4 {
+		fw = fwe[:4]
+	}
+	fw = strings.TrimLeft(fw, "0")
+	if len(fw) < 3 {
+		return fw
+	}
+	return fw[:len(fw)-2] + "." + fw[len(fw)-2:]
+}
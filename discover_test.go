@@ -0,0 +1,90 @@
+package vedirect
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiscover(t *testing.T) {
+	dir := t.TempDir()
+	frame := testFrame("PID", "0xA053", "FW", "159", "SER#", "HQ1234ABCDE", "V", "13820")
+	err := os.WriteFile(filepath.Join(dir, "ttyUSB0"), frame, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "ttyUSB1"), []byte("AT\r\nOK\r\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// reported once, by the first pattern's name
+	err = os.Symlink(filepath.Join(dir, "ttyUSB0"), filepath.Join(dir, "usb-VictronEnergy_BV_VE_Direct_cable"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := Discover(context.Background(), DiscoverOptions{
+		Patterns: []string{filepath.Join(dir, "*VictronEnergy*"), filepath.Join(dir, "tty*")},
+		Timeout:  100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq(t, 1, len(found))
+	dev := found[0]
+	eq(t, filepath.Join(dir, "usb-VictronEnergy_BV_VE_Direct_cable"), dev.Path)
+	eq(t, ProductID(0xA053), dev.PID)
+	eq(t, "SmartSolar MPPT 75|15", dev.Model)
+	eq(t, FamilyMPPT, dev.Family)
+	eq(t, "HQ1234ABCDE", dev.Serial)
+	eq(t, "1.59", dev.Firmware)
+}
+
+func TestIdentifyHex(t *testing.T) {
+	// a device that doesn't send text frames
+	dev := newTestDevice(nil)
+	dev.pid = 0xA389
+	dev.version = 0x4415
+	out := make(chan map[string]string, 10)
+	v := New(dev, out, Options{HexTimeout: 50 * time.Millisecond})
+	defer v.Close()
+	var dd DiscoveredDevice
+	err := identify(context.Background(), v, out, &dd, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq(t, ProductID(0xA389), dd.PID)
+	eq(t, FamilyBMV, dd.Family)
+	eq(t, "", dd.Serial)
+	eq(t, "4.15", dd.Firmware)
+
+	// busy device, more records than out holds arrive while waiting for the HEX replies
+	dev = newTestDevice(nil)
+	dev.pid = 0xA053
+	dev.version = 0x4159
+	dev.ignore = 1
+	out = make(chan map[string]string, 10)
+	v2 := New(dev, out, Options{HexTimeout: 20 * time.Millisecond})
+	defer v2.Close()
+	var frames []byte
+	for i := 0; i < 30; i++ {
+		frames = append(frames, testFrame("V", "13820")...)
+	}
+	go func() {
+		for dev.Requests() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		dev.send(frames)
+	}()
+	dd = DiscoveredDevice{}
+	err = identify(context.Background(), v2, out, &dd, 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq(t, ProductID(0xA053), dd.PID)
+	eq(t, "1.59", dd.Firmware)
+
+	eq(t, "4.15", firmwareFromText("", "0415FF"))
+	eq(t, "1.59", firmwareFromText("159", ""))
+}
@@ -0,0 +1,98 @@
+package vedirect
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var ErrTextField = errors.New("field can't be sent in a text frame")
+
+// fields sent first, in this order, by EncodeTextFrame
+var textFrameFirst = []string{"PID", "FW", "FWE", "SER#"}
+
+// AppendTextBlock appends a text protocol block: "\r\n{key}\t{value}" for each key, value pair, then "\r\nChecksum\t" and the byte that makes the block sum to 0.
+// Keys and values must not contain '\r', '\n', '\t' or ':'; EncodeTextFrame checks.
+func AppendTextBlock(out []byte, kv ...string) []byte {
+	start := len(out)
+	for i := 0; i+1 < len(kv); i += 2 {
+		out = append(out, "\r\n"...)
+		out = append(out, kv[i]...)
+		out = append(out, delimiter)
+		out = append(out, kv[i+1]...)
+	}
+	out = append(out, "\r\nChecksum\t"...)
+	var sum byte
+	for _, c := range out[start:] {
+		sum += c
+	}
+	return append(out, -sum)
+}
+
+// EncodeTextFrame encodes a record as a checksummed text block, as a device would send it.
+//
+// PID, FW, FWE and SER# come first, then the other fields sorted by name.
+// Fields added by this package ("_t", "_x", "_c", "_d", "{k}_label") are left out.
+func EncodeTextFrame(rec map[string]string) ([]byte, error) {
+	kv := make([]string, 0, 2*len(rec))
+	for _, k := range textFrameFirst {
+		if value, ok := rec[k]; ok {
+			kv = append(kv, k, value)
+		}
+	}
+	keys := make([]string, 0, len(rec))
+	for k := range rec {
+		if strings.HasPrefix(k, "_") || isLabelField(k) || k == "Checksum" {
+			continue
+		}
+		first := false
+		for _, fk := range textFrameFirst {
+			first = first || fk == k
+		}
+		if !first {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		kv = append(kv, k, rec[k])
+	}
+	for i := 0; i < len(kv); i += 2 {
+		if kv[i] == "" || strings.ContainsAny(kv[i], "\r\n\t:") || strings.ContainsAny(kv[i+1], "\r\n\t:") {
+			return nil, fmt.Errorf("%w: %#v %#v", ErrTextField, kv[i], kv[i+1])
+		}
+	}
+	return AppendTextBlock(nil, kv...), nil
+}
+
+const hexDigits = "0123456789ABCDEF"
+
+// appendHexLine appends ":{code nybble}{data as hex}{checksum}\n"
+func appendHexLine(out []byte, code byte, data []byte) []byte {
+	sum := code
+	out = append(out, hexmarker, hexDigits[code&0xf])
+	for _, c := range data {
+		sum += c
+		out = append(out, hexDigits[c>>4], hexDigits[c&0xf])
+	}
+	cs := 0x55 - sum
+	return append(out, hexDigits[cs>>4], hexDigits[cs&0xf], '\n')
+}
+
+// EncodeHexMessage formats a HEX message from a device, e.g. EncodeHexMessage(HexPing, []byte{0x16, 0x41}) is ":51641F9\n"
+func EncodeHexMessage(resp HexResponse, data []byte) []byte {
+	return appendHexLine(nil, byte(resp), data)
+}
+
+// Encode formats the message as a device would send it, the reverse of ParseHexMessage
+func (m *HexMessage) Encode() []byte {
+	if !m.Response.IsRegister() {
+		return EncodeHexMessage(m.Response, m.Data)
+	}
+	data := make([]byte, 3, 3+len(m.Data))
+	binary.LittleEndian.PutUint16(data, m.Register)
+	data[2] = m.Flags
+	return EncodeHexMessage(m.Response, append(data, m.Data...))
+}
@@ -0,0 +1,68 @@
+package vedirect
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// parse a stream with NewReader
+func parseStream(stream []byte) []map[string]string {
+	out := make(chan map[string]string, 10)
+	NewReader(bytes.NewReader(stream), out, Options{})
+	return readAll(out)
+}
+
+func TestEncodeTextFrame(t *testing.T) {
+	rec := map[string]string{
+		"V": "13820", "SER#": "HQ1234ABCDE", "PID": "0xA053", "I": "-100", "FW": "159",
+		"_t": "1665000000000", "CS": "3", "CS_label": "Bulk",
+	}
+	frame, err := EncodeTextFrame(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq(t, string(testFrame("PID", "0xA053", "FW", "159", "SER#", "HQ1234ABCDE", "CS", "3", "I", "-100", "V", "13820")), string(frame))
+
+	recs := parseStream(append(frame, frame...))
+	eq(t, 2, len(recs))
+	for _, parsed := range recs {
+		eq(t, 6, len(parsed))
+		for k, v := range parsed {
+			eq(t, rec[k], v)
+		}
+	}
+
+	_, err = EncodeTextFrame(map[string]string{"PID": "0xA053", "X": "a:b"})
+	eq(t, true, errors.Is(err, ErrTextField))
+	_, err = EncodeTextFrame(map[string]string{"A\tB": "1"})
+	eq(t, true, errors.Is(err, ErrTextField))
+}
+
+func TestEncodeHexMessage(t *testing.T) {
+	eq(t, ":51641F9\n", string(EncodeHexMessage(HexPing, []byte{0x16, 0x41})))
+	eq(t, ":7F0ED0071\n", string(formatHexCommand(Get, []byte{0xf0, 0xed, 0x00})))
+
+	msgs := []HexMessage{
+		{Response: HexGet, Register: 0xedf0, Data: []byte{0x96, 0x00}},
+		{Response: HexAsync, Register: 0xedbb, Data: []byte{0x10, 0x27}},
+		{Response: HexSet, Register: 0x1234, Flags: hexFlagUnknownID},
+		{Response: HexDone, Data: []byte{0x53, 0xa0}},
+		{Response: HexUnknown},
+	}
+	var stream []byte
+	for _, m := range msgs {
+		stream = append(stream, m.Encode()...)
+	}
+	recs := parseStream(stream)
+	eq(t, len(msgs), len(recs))
+	for i, rec := range recs {
+		parsed, err := ParseHexMessage(rec["_x"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		eq(t, string(msgs[i].Encode()), string(parsed.Encode()))
+		eq(t, msgs[i].Register, parsed.Register)
+		eq(t, msgs[i].Flags, parsed.Flags)
+	}
+}
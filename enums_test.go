@@ -0,0 +1,80 @@
+package vedirect
+
+import (
+	"reflect"
+	"testing"
+)
+
+type enumCase struct {
+	k     string
+	v     string
+	value int64
+	label string
+	flags []string
+}
+
+var enumCases = []enumCase{
+	{"CS", "3", 3, "Bulk", nil},
+	{"CS", "5", 5, "Float", nil},
+	{"CS", "99", 99, "ChargeState(99)", nil},
+	{"ERR", "0", 0, "No error", nil},
+	{"ERR", "33", 33, "Input voltage too high (solar panel)", nil},
+	{"OR", "0x00000001", 1, "No input power", []string{"No input power"}},
+	{"OR", "0x00000000", 0, "none", nil},
+	{"AR", "66", 66, "High Voltage, High Temperature", []string{"High Voltage", "High Temperature"}},
+	{"WARN", "4", 4, "Low SOC", []string{"Low SOC"}},
+	{"MPPT", "2", 2, "MPP Tracker active", nil},
+	{"MODE", "253", 253, "Hibernate", nil},
+	{"PID", "0xA053", 0xA053, "SmartSolar MPPT 75|15", nil},
+	{"PID", "0xA3FF", 0xA3FF, "0xA3FF", nil},
+}
+
+func TestDecodeEnumField(t *testing.T) {
+	for i, tc := range enumCases {
+		ev, err := DecodeEnumField(tc.k, tc.v)
+		if err != nil {
+			t.Errorf("[%d] %s=%#v: %v", i, tc.k, tc.v, err)
+			continue
+		}
+		if ev.Raw != tc.v || ev.Value != tc.value || ev.Label != tc.label || !reflect.DeepEqual(ev.Flags, tc.flags) {
+			t.Errorf("[%d] %s=%#v got %#v", i, tc.k, tc.v, ev)
+		}
+	}
+	_, err := DecodeEnumField("V", "12000")
+	eq(t, ErrNotEnumField, err)
+}
+
+func TestProductFamily(t *testing.T) {
+	eq(t, FamilyMPPT, ProductFamilyForPID(0xA053))
+	eq(t, FamilyBMV, ProductFamilyForPID(0xA389))
+	eq(t, FamilyInverter, ProductFamilyForPID(0xA2FE))
+	eq(t, FamilyUnknown, ProductFamilyForPID(0x1234))
+	p, ok := ProductID(0xA381).Product()
+	eq(t, true, ok)
+	eq(t, "BMV-712 Smart", p.Name)
+}
+
+func TestRecordLabels(t *testing.T) {
+	srec := map[string]string{"CS": "4", "OR": "0x00000000", "V": "12000"}
+	AddStringRecordLabels(srec)
+	eq(t, "Absorption", srec["CS_label"])
+	eq(t, "none", srec["OR_label"])
+	eq(t, 5, len(srec))
+
+	rec, _ := DecodeRecord(map[string]string{"CS": "5"})
+	cs, ok := rec.ChargeState()
+	eq(t, true, ok)
+	eq(t, ChargeState(5), cs)
+	_, ok = rec.ErrorCode()
+	eq(t, false, ok)
+
+	// summary of labelled records relabels the summarized value
+	they := []map[string]interface{}{
+		ParseRecord(map[string]string{"CS": "3", "CS_label": "Bulk"}),
+		ParseRecord(map[string]string{"CS": "4", "CS_label": "Absorption"}),
+		ParseRecord(map[string]string{"CS": "4", "CS_label": "Absorption"}),
+	}
+	sum := summarize(they, false)
+	eq(t, "4", sum["CS"])
+	eq(t, "Absorption", sum["CS_label"])
+}
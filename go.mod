@@ -3,6 +3,6 @@ module github.com/brianolson/vedirect
 go 1.18
 
 require (
-	github.com/tarm/serial v0.0.0-20180830185346-98f6abe2eb07 // indirect
-	golang.org/x/sys v0.1.0 // indirect
+	github.com/tarm/serial v0.0.0-20180830185346-98f6abe2eb07
+	golang.org/x/sys v0.1.0
 )
@@ -0,0 +1,446 @@
+package vedirect
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Synchronous HEX protocol requests: send a command, wait for the matching response.
+
+// DefaultHexTimeout is the default for Options.HexTimeout
+const DefaultHexTimeout = time.Second
+
+// DefaultHexRetries is the default for Options.HexRetries
+const DefaultHexRetries = 2
+
+var ErrHexTimeout = errors.New("VE HEX no response")
+
+// Flags byte of a HEX Get (0x7) or Set (0x8) response.
+// Match with errors.Is(err, ErrHexUnknownRegister) etc.
+var (
+	ErrHexUnknownRegister = errors.New("VE HEX unknown register id")
+	ErrHexNotSupported    = errors.New("VE HEX register not supported")
+	ErrHexParameter       = errors.New("VE HEX parameter error")
+)
+
+// Responses to a bad command, see HexMessage.Err
+var (
+	ErrHexUnknownCommand = errors.New("VE HEX unknown command")
+	ErrHexFraming        = errors.New("VE HEX framing error")
+)
+
+const (
+	hexFlagUnknownID    = 0x01
+	hexFlagNotSupported = 0x02
+	hexFlagParameter    = 0x04
+)
+
+// HexFlagError is a HEX register response with non-zero flags
+type HexFlagError struct {
+	Register uint16
+	Flags    byte
+}
+
+func (e *HexFlagError) Error() string {
+	var names []string
+	if e.Flags&hexFlagUnknownID != 0 {
+		names = append(names, "unknown register id")
+	}
+	if e.Flags&hexFlagNotSupported != 0 {
+		names = append(names, "not supported")
+	}
+	if e.Flags&hexFlagParameter != 0 {
+		names = append(names, "parameter error")
+	}
+	if e.Flags&^(hexFlagUnknownID|hexFlagNotSupported|hexFlagParameter) != 0 {
+		names = append(names, "unknown flag")
+	}
+	return fmt.Sprintf("VE HEX register 0x%04x flags 0x%02x (%s)", e.Register, e.Flags, strings.Join(names, ", "))
+}
+
+// Is supports errors.Is(err, ErrHexUnknownRegister), ErrHexNotSupported, ErrHexParameter
+func (e *HexFlagError) Is(target error) bool {
+	switch target {
+	case ErrHexUnknownRegister:
+		return e.Flags&hexFlagUnknownID != 0
+	case ErrHexNotSupported:
+		return e.Flags&hexFlagNotSupported != 0
+	case ErrHexParameter:
+		return e.Flags&hexFlagParameter != 0
+	}
+	return false
+}
+
+// responses are matched on response code and (for register responses) address
+type hexWaitKey struct {
+	resp byte
+	addr uint16
+}
+
+func hexKeyOf(hbytes []byte) hexWaitKey {
+	key := hexWaitKey{resp: hbytes[0]}
+	switch Command(hbytes[0]) {
+	case Get, Set, Async:
+		if len(hbytes) >= 3 {
+			key.addr = binary.LittleEndian.Uint16(hbytes[1:3])
+		}
+	}
+	return key
+}
+
+// a HEX request waiting for its response
+type hexWaiter struct {
+	key hexWaitKey
+	ch  chan []byte
+}
+
+// deliverHex hands a checksummed HEX message to a waiting request.
+// Unknown command and framing error responses don't say what they answer, they go to the oldest request.
+// Returns true if it was consumed.
+func (v *Vedirect) deliverHex(hbytes []byte) bool {
+	key := hexKeyOf(hbytes)
+	anyWaiter := HexResponse(hbytes[0]) == HexUnknown || HexResponse(hbytes[0]) == HexError
+	v.hl.Lock()
+	defer v.hl.Unlock()
+	for i, w := range v.waiters {
+		if anyWaiter || w.key == key {
+			// hbytes is the parser's buffer
+			w.ch <- append([]byte(nil), hbytes...)
+			v.waiters = append(v.waiters[:i], v.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (v *Vedirect) addWaiter(key hexWaitKey, ch chan []byte) {
+	v.hl.Lock()
+	defer v.hl.Unlock()
+	v.waiters = append(v.waiters, hexWaiter{key, ch})
+}
+
+func (v *Vedirect) removeWaiter(ch chan []byte) {
+	v.hl.Lock()
+	defer v.hl.Unlock()
+	for i, w := range v.waiters {
+		if w.ch == ch {
+			v.waiters = append(v.waiters[:i], v.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// hexRequest sends cmd+msg and waits for a response matching key, resending on timeout.
+// Returns the decoded response bytes (including response code and checksum byte), or ErrHexUnknownCommand or ErrHexFraming if the device answered with one of those.
+func (v *Vedirect) hexRequest(ctx context.Context, cmd Command, msg []byte, key hexWaitKey) ([]byte, error) {
+	timeout := v.opts.HexTimeout
+	if timeout == 0 {
+		timeout = DefaultHexTimeout
+	}
+	retries := v.opts.HexRetries
+	if retries == 0 {
+		retries = DefaultHexRetries
+	} else if retries < 0 {
+		retries = 0
+	}
+	ch := make(chan []byte, 1)
+	v.addWaiter(key, ch)
+	defer v.removeWaiter(ch)
+	for attempt := 0; attempt <= retries; attempt++ {
+		err := v.SendHexCommand(cmd, msg)
+		if err != nil {
+			return nil, err
+		}
+		timer := time.NewTimer(timeout)
+		select {
+		case hbytes := <-ch:
+			timer.Stop()
+			if resp := HexResponse(hbytes[0]); resp == HexUnknown || resp == HexError {
+				return nil, (&HexMessage{Response: resp}).Err()
+			}
+			return hbytes, nil
+		case <-timer.C:
+			v.debug("HEX %x: no response after %s (attempt %d)", msg, timeout, attempt+1)
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-v.done:
+			timer.Stop()
+			return nil, v.closedErr()
+		}
+	}
+	return nil, ErrHexTimeout
+}
+
+var ErrClosed = errors.New("vedirect closed")
+
+// error for requests made after the read thread has exited
+func (v *Vedirect) closedErr() error {
+	err := v.Err()
+	if err == nil {
+		return ErrClosed
+	}
+	return fmt.Errorf("%w, %v", ErrClosed, err)
+}
+
+// GetRegister reads a register with a HEX Get command and waits for the response.
+//
+// The request is resent after Options.HexTimeout, up to Options.HexRetries times.
+// A response with error flags returns a *HexFlagError, which matches errors.Is(err, ErrHexUnknownRegister) etc.
+// The response is not also sent to the out channel as an "_x" record.
+// A register not in the device's register tables returns its raw bytes as a []byte Value, with an error matching errors.Is(err, ErrUnknownRegisterDef).
+func (v *Vedirect) GetRegister(ctx context.Context, addr uint16) (*VERegValue, error) {
+	msg := make([]byte, 3)
+	binary.LittleEndian.PutUint16(msg, addr)
+	hbytes, err := v.hexRequest(ctx, Get, msg, hexWaitKey{byte(Get), addr})
+	if err != nil {
+		return nil, err
+	}
+	return parseRegisterMessage(hbytes, v.registry(), v.Product())
+}
+
+var ErrHexSetMismatch = errors.New("VE HEX set response value differs from value sent")
+
+// SetRegister encodes value with EncodeRegisterValue, writes it with a HEX Set command and waits for the device to echo it back.
+// value is in the register's display units, e.g. 14.4 or 14 (V), or a RawValue.
+//
+// Returns the register value from the response.
+// If the device answers with a different value (e.g. it clamped the setting) the error matches errors.Is(err, ErrHexSetMismatch).
+func (v *Vedirect) SetRegister(ctx context.Context, reg VERegister, value any) (*VERegValue, error) {
+	data, err := EncodeRegisterValue(reg, value)
+	if err != nil {
+		return nil, err
+	}
+	msg := make([]byte, 3, 3+len(data))
+	binary.LittleEndian.PutUint16(msg, reg.Address)
+	msg = append(msg, data...)
+	hbytes, err := v.hexRequest(ctx, Set, msg, hexWaitKey{byte(Set), reg.Address})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := parseHexBytes(hbytes)
+	if err != nil {
+		return nil, err
+	}
+	if err = resp.Err(); err != nil {
+		return nil, err
+	}
+	echo := resp.Data
+	rv, err := parseByRegType(echo, reg.Size)
+	if err != nil {
+		return nil, err
+	}
+	rvalue := &VERegValue{Register: reg, Value: rv}
+	if !bytes.Equal(echo, data) {
+		return rvalue, fmt.Errorf("%w: %s sent %x got %x", ErrHexSetMismatch, reg.Name, data, echo)
+	}
+	return rvalue, nil
+}
+
+// FirmwareType is the top two bits of a firmware version
+type FirmwareType uint8
+
+const (
+	FirmwareBootloader       FirmwareType = 0
+	FirmwareApplication      FirmwareType = 1
+	FirmwareTester           FirmwareType = 2
+	FirmwareReleaseCandidate FirmwareType = 3
+)
+
+var firmwareTypeNames = []string{"bootloader", "application", "tester", "release candidate"}
+
+func (ft FirmwareType) String() string {
+	return firmwareTypeNames[ft&3]
+}
+
+// FirmwareVersion as returned by Ping or AppVersion, e.g. 0x4116 is application version 1.16
+type FirmwareVersion uint16
+
+// Type of the running firmware
+func (fv FirmwareVersion) Type() FirmwareType {
+	return FirmwareType(fv >> 14)
+}
+
+// Version without the type bits, e.g. 0x0116
+func (fv FirmwareVersion) Version() uint16 {
+	return uint16(fv) & 0x3fff
+}
+
+// String e.g. "1.16"
+func (fv FirmwareVersion) String() string {
+	ver := fv.Version()
+	return fmt.Sprintf("%x.%02x", ver>>8, ver&0xff)
+}
+
+// data part of a [response, data..., checksum] reply
+func hexReplyUint16(hbytes []byte) (uint16, error) {
+	if len(hbytes) < 4 {
+		return 0, ErrHexDataShort
+	}
+	return binary.LittleEndian.Uint16(hbytes[1:3]), nil
+}
+
+// Ping the device, returns its firmware version.
+func (v *Vedirect) Ping(ctx context.Context) (FirmwareVersion, error) {
+	hbytes, err := v.hexRequest(ctx, Ping, nil, hexWaitKey{resp: byte(HexPing)})
+	if err != nil {
+		return 0, err
+	}
+	ver, err := hexReplyUint16(hbytes)
+	return FirmwareVersion(ver), err
+}
+
+// AppVersion and ProductId are both answered with a Done response, so only one can be waiting at a time
+func (v *Vedirect) doneRequest(ctx context.Context, cmd Command) ([]byte, error) {
+	v.dl.Lock()
+	defer v.dl.Unlock()
+	return v.hexRequest(ctx, cmd, nil, hexWaitKey{resp: byte(HexDone)})
+}
+
+// FirmwareVersion asks the device for its application version.
+func (v *Vedirect) FirmwareVersion(ctx context.Context) (FirmwareVersion, error) {
+	hbytes, err := v.doneRequest(ctx, AppVersion)
+	if err != nil {
+		return 0, err
+	}
+	ver, err := hexReplyUint16(hbytes)
+	return FirmwareVersion(ver), err
+}
+
+// ProductID asks the device for its PID. An unknown PID gets its name from ProductID.String().
+func (v *Vedirect) ProductID(ctx context.Context) (Product, error) {
+	hbytes, err := v.doneRequest(ctx, ProductId)
+	if err != nil {
+		return Product{}, err
+	}
+	pid, err := hexReplyUint16(hbytes)
+	if err != nil {
+		return Product{}, err
+	}
+	v.setProduct(ProductID(pid))
+	p, _ := ProductID(pid).Product()
+	return p, nil
+}
+
+// Product is the PID of the device, from its text frames or ProductID, or Options.Product. 0 if not known yet.
+// Register values are decoded with the device's register table once it is known, see Registry.
+func (v *Vedirect) Product() ProductID {
+	v.l.Lock()
+	defer v.l.Unlock()
+	return v.product
+}
+
+func (v *Vedirect) setProduct(pid ProductID) {
+	v.l.Lock()
+	defer v.l.Unlock()
+	v.product = pid
+}
+
+func (v *Vedirect) registry() *Registry {
+	if v.opts.Registry != nil {
+		return v.opts.Registry
+	}
+	return DefaultRegistry
+}
+
+// RegisterUpdate is a register value from an asynchronous (0xA) HEX message
+type RegisterUpdate struct {
+	VERegValue
+	Time time.Time
+}
+
+// Subscribe sends asynchronous updates of register addr to ch.
+//
+// Sends do not block the reader; an update is dropped if ch is full, so ch should be buffered.
+// ch is never closed by Vedirect. Updates are still sent to the out channel as "_x" records.
+func (v *Vedirect) Subscribe(addr uint16, ch chan<- RegisterUpdate) {
+	v.hl.Lock()
+	defer v.hl.Unlock()
+	if v.subs == nil {
+		v.subs = make(map[uint16][]chan<- RegisterUpdate)
+	}
+	v.subs[addr] = append(v.subs[addr], ch)
+}
+
+// SubscribeAll sends asynchronous updates of every known register to ch, as Subscribe
+func (v *Vedirect) SubscribeAll(ch chan<- RegisterUpdate) {
+	v.hl.Lock()
+	defer v.hl.Unlock()
+	v.subsAll = append(v.subsAll, ch)
+}
+
+// Unsubscribe removes ch from all subscriptions
+func (v *Vedirect) Unsubscribe(ch chan<- RegisterUpdate) {
+	v.hl.Lock()
+	defer v.hl.Unlock()
+	for addr, chans := range v.subs {
+		chans = removeSub(chans, ch)
+		if len(chans) == 0 {
+			delete(v.subs, addr)
+		} else {
+			v.subs[addr] = chans
+		}
+	}
+	v.subsAll = removeSub(v.subsAll, ch)
+}
+
+func removeSub(chans []chan<- RegisterUpdate, ch chan<- RegisterUpdate) []chan<- RegisterUpdate {
+	out := chans[:0]
+	for _, sc := range chans {
+		if sc != ch {
+			out = append(out, sc)
+		}
+	}
+	return out
+}
+
+// publishAsync decodes an Async message for subscribers
+func (v *Vedirect) publishAsync(hbytes []byte) {
+	v.hl.Lock()
+	defer v.hl.Unlock()
+	if len(v.subsAll) == 0 && len(v.subs) == 0 {
+		return
+	}
+	rv, err := parseRegisterMessage(hbytes, v.registry(), v.Product())
+	if err != nil {
+		v.debug("async update: %v", err)
+		return
+	}
+	update := RegisterUpdate{VERegValue: *rv, Time: time.Now()}
+	for _, ch := range v.subs[rv.Register.Address] {
+		v.sendUpdate(ch, update)
+	}
+	for _, ch := range v.subsAll {
+		v.sendUpdate(ch, update)
+	}
+}
+
+func (v *Vedirect) sendUpdate(ch chan<- RegisterUpdate, update RegisterUpdate) {
+	select {
+	case ch <- update:
+	default:
+		v.debug("subscriber full, dropped update of 0x%04x", update.Register.Address)
+	}
+}
+
+var ErrNoAsyncUpdatesRegister = errors.New("vedirect Options.AsyncUpdatesRegister not set")
+
+// SetAsyncUpdates turns the device's asynchronous register updates on or off by writing 1 or 0 to Options.AsyncUpdatesRegister.
+//
+// Which register controls asynchronous updates depends on the product and firmware, so there is no default.
+func (v *Vedirect) SetAsyncUpdates(ctx context.Context, on bool) error {
+	if v.opts.AsyncUpdatesRegister == nil {
+		return ErrNoAsyncUpdatesRegister
+	}
+	value := 0
+	if on {
+		value = 1
+	}
+	_, err := v.SetRegister(ctx, *v.opts.AsyncUpdatesRegister, value)
+	return err
+}
@@ -0,0 +1,308 @@
+package vedirect
+
+import (
+	"context"
+	"encoding/binary"
+	ehex "encoding/hex"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testDevice answers HEX commands written to it from a register map
+type testDevice struct {
+	pr *io.PipeReader
+	pw *io.PipeWriter
+
+	l        sync.Mutex
+	regs     map[uint16][]byte
+	fixed    map[uint16]bool // Set doesn't change these
+	version  uint16
+	pid      uint16
+	ignore   int // drop this many requests before answering
+	requests int
+}
+
+func newTestDevice(regs map[uint16][]byte) *testDevice {
+	pr, pw := io.Pipe()
+	return &testDevice{pr: pr, pw: pw, regs: regs}
+}
+
+func (d *testDevice) Read(p []byte) (int, error) {
+	return d.pr.Read(p)
+}
+
+func (d *testDevice) Close() error {
+	d.pr.Close()
+	return d.pw.Close()
+}
+
+// send bytes from the device
+func (d *testDevice) send(b []byte) {
+	go d.pw.Write(b)
+}
+
+func (d *testDevice) Write(p []byte) (int, error) {
+	// ":" command nybble, hex bytes, checksum, "\n"
+	msg, err := ehex.DecodeString(string(p[2 : len(p)-3]))
+	if err != nil {
+		return 0, err
+	}
+	c, err := strconv.ParseUint(string(p[1:2]), 16, 8)
+	if err != nil {
+		return 0, err
+	}
+	cmd := Command(c)
+	d.l.Lock()
+	defer d.l.Unlock()
+	d.requests++
+	if d.ignore > 0 {
+		d.ignore--
+		return len(p), nil
+	}
+	if reply := d.reply(cmd, msg); reply != nil {
+		d.send(reply)
+	}
+	return len(p), nil
+}
+
+func (d *testDevice) reply(cmd Command, msg []byte) []byte {
+	u16 := make([]byte, 2)
+	switch cmd {
+	case Ping:
+		binary.LittleEndian.PutUint16(u16, d.version)
+		return formatHexCommand(Command(HexPing), u16)
+	case AppVersion:
+		binary.LittleEndian.PutUint16(u16, d.version)
+		return formatHexCommand(Command(HexDone), u16)
+	case ProductId:
+		binary.LittleEndian.PutUint16(u16, d.pid)
+		return formatHexCommand(Command(HexDone), u16)
+	case Get:
+		addr := binary.LittleEndian.Uint16(msg)
+		value, ok := d.regs[addr]
+		if !ok {
+			return formatHexCommand(Get, []byte{msg[0], msg[1], hexFlagUnknownID})
+		}
+		return formatHexCommand(Get, append([]byte{msg[0], msg[1], 0}, value...))
+	case Set:
+		addr := binary.LittleEndian.Uint16(msg)
+		if _, ok := d.regs[addr]; !ok {
+			return formatHexCommand(Set, []byte{msg[0], msg[1], hexFlagUnknownID})
+		}
+		if !d.fixed[addr] {
+			d.regs[addr] = append([]byte(nil), msg[3:]...)
+		}
+		return formatHexCommand(Set, append([]byte{msg[0], msg[1], 0}, d.regs[addr]...))
+	}
+	return nil
+}
+
+func (d *testDevice) Requests() int {
+	d.l.Lock()
+	defer d.l.Unlock()
+	return d.requests
+}
+
+func TestGetRegister(t *testing.T) {
+	dev := newTestDevice(map[uint16][]byte{0xedf0: {0x96, 0x00}})
+	out := make(chan map[string]string, 10)
+	v := New(dev, out, Options{HexTimeout: 50 * time.Millisecond})
+	defer v.Close()
+	ctx := context.Background()
+
+	rv, err := v.GetRegister(ctx, 0xedf0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq(t, uint16(150), rv.Value)
+	eq(t, "battery maximum current", rv.Register.Name)
+
+	_, err = v.GetRegister(ctx, 0x1234)
+	eq(t, true, errors.Is(err, ErrHexUnknownRegister))
+	eq(t, false, errors.Is(err, ErrHexParameter))
+	var fe *HexFlagError
+	eq(t, true, errors.As(err, &fe))
+	eq(t, uint16(0x1234), fe.Register)
+
+	// first request lost, resent after timeout
+	dev.l.Lock()
+	dev.ignore = 1
+	dev.l.Unlock()
+	before := dev.Requests()
+	rv, err = v.GetRegister(ctx, 0xedf0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq(t, uint16(150), rv.Value)
+	eq(t, 2, dev.Requests()-before)
+
+	// unsolicited update still goes to out, answered requests did not
+	dev.send(formatHexCommand(Async, []byte{0xf0, 0xed, 0, 0x97, 0}))
+	select {
+	case rec := <-out:
+		eq(t, "0AF0ED009700D7", rec["_x"])
+	case <-time.After(5 * time.Second):
+		t.Fatal("no async record")
+	}
+	eq(t, 0, len(out))
+}
+
+func TestGetRegisterNotInTables(t *testing.T) {
+	dev := newTestDevice(map[uint16][]byte{0x4321: {0x01, 0x02}})
+	v := New(dev, make(chan map[string]string, 10), Options{HexTimeout: 50 * time.Millisecond})
+	defer v.Close()
+	rv, err := v.GetRegister(context.Background(), 0x4321)
+	eq(t, true, errors.Is(err, ErrUnknownRegisterDef))
+	if rv == nil {
+		t.Fatal("no raw value")
+	}
+	eq(t, uint16(0x4321), rv.Register.Address)
+	eq(t, "0102", ehex.EncodeToString(rv.Value.([]byte)))
+	eq(t, "0102", rv.String())
+}
+
+func TestHexErrorResponse(t *testing.T) {
+	dev := newTestDevice(map[uint16][]byte{0xedf0: {0x96, 0x00}})
+	dev.ignore = 1
+	v := New(dev, make(chan map[string]string, 10), Options{HexTimeout: 5 * time.Second})
+	defer v.Close()
+	go func() {
+		for dev.Requests() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		dev.send(formatHexCommand(Command(HexUnknown), nil))
+	}()
+	_, err := v.GetRegister(context.Background(), 0xedf0)
+	eq(t, ErrHexUnknownCommand, err)
+	eq(t, 1, dev.Requests())
+}
+
+func TestGetRegisterTimeout(t *testing.T) {
+	dev := newTestDevice(nil)
+	dev.ignore = 10
+	v := New(dev, make(chan map[string]string, 10), Options{HexTimeout: 10 * time.Millisecond, HexRetries: -1})
+	_, err := v.GetRegister(context.Background(), 0xedf0)
+	eq(t, ErrHexTimeout, err)
+	eq(t, 1, dev.Requests())
+
+	ctx, cf := context.WithCancel(context.Background())
+	cf()
+	_, err = v.GetRegister(ctx, 0xedf0)
+	eq(t, context.Canceled, err)
+
+	v.Close()
+	_, err = v.GetRegister(context.Background(), 0xedf0)
+	eq(t, true, errors.Is(err, ErrClosed))
+}
+
+func TestSetRegister(t *testing.T) {
+	dev := newTestDevice(map[uint16][]byte{0xedf0: {0x96, 0x00}, 0xedf7: {0x78, 0x05}})
+	dev.fixed = map[uint16]bool{0xedf7: true}
+	v := New(dev, make(chan map[string]string, 10), Options{HexTimeout: 50 * time.Millisecond})
+	defer v.Close()
+	ctx := context.Background()
+	scale := 0.1
+	maxCurrent := VERegister{Address: 0xedf0, Name: "battery maximum current", Scale: &scale, Size: RegType_u16, Unit: "A"}
+
+	rv, err := v.SetRegister(ctx, maxCurrent, 20.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq(t, uint16(200), rv.Value)
+	dev.l.Lock()
+	eq(t, "c800", ehex.EncodeToString(dev.regs[0xedf0]))
+	dev.l.Unlock()
+
+	// device keeps its own value
+	absorption := VERegister{Address: 0xedf7, Name: "battery absorption voltage", Scale: &scale, Size: RegType_u16}
+	rv, err = v.SetRegister(ctx, absorption, 14.2)
+	eq(t, true, errors.Is(err, ErrHexSetMismatch))
+	eq(t, uint16(0x578), rv.Value)
+
+	_, err = v.SetRegister(ctx, VERegister{Address: 0x1234, Size: RegType_u8}, 1)
+	eq(t, true, errors.Is(err, ErrHexUnknownRegister))
+
+	_, err = v.SetRegister(ctx, maxCurrent, -1.0)
+	eq(t, true, errors.Is(err, ErrHexValueRange))
+}
+
+func TestPingVersionProduct(t *testing.T) {
+	dev := newTestDevice(nil)
+	dev.version = 0x4116
+	dev.pid = 0xA053
+	v := New(dev, make(chan map[string]string, 10), Options{HexTimeout: 50 * time.Millisecond})
+	defer v.Close()
+	ctx := context.Background()
+
+	fv, err := v.Ping(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq(t, FirmwareVersion(0x4116), fv)
+	eq(t, FirmwareApplication, fv.Type())
+	eq(t, "1.16", fv.String())
+	eq(t, "application", fv.Type().String())
+
+	fv, err = v.FirmwareVersion(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq(t, uint16(0x116), fv.Version())
+
+	p, err := v.ProductID(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq(t, ProductID(0xA053), p.PID)
+	eq(t, "SmartSolar MPPT 75|15", p.Name)
+	eq(t, FamilyMPPT, p.Family)
+	eq(t, FirmwareBootloader, FirmwareVersion(0x0116).Type())
+}
+
+func TestSubscribe(t *testing.T) {
+	dev := newTestDevice(map[uint16][]byte{0xedda: {0}})
+	out := make(chan map[string]string, 10)
+	v := New(dev, out, Options{HexTimeout: 50 * time.Millisecond})
+	defer v.Close()
+	errs := make(chan RegisterUpdate, 10)
+	all := make(chan RegisterUpdate, 10)
+	v.Subscribe(0xedda, errs)
+	v.SubscribeAll(all)
+
+	dev.send(formatHexCommand(Async, []byte{0xbb, 0xed, 0, 0x10, 0x27}))
+	dev.send(formatHexCommand(Async, []byte{0xda, 0xed, 0, 33}))
+	for i := 0; i < 2; i++ {
+		select {
+		case <-out:
+		case <-time.After(5 * time.Second):
+			t.Fatal("no _x record")
+		}
+	}
+	eq(t, 1, len(errs))
+	eq(t, 2, len(all))
+	u := <-errs
+	eq(t, uint8(33), u.Value)
+	eq(t, "charger error code", u.Register.Name)
+	if u.Time.IsZero() {
+		t.Error("update Time not set")
+	}
+
+	// GetRegister responses are not async updates
+	_, err := v.GetRegister(context.Background(), 0xedda)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq(t, 0, len(errs))
+
+	v.Unsubscribe(errs)
+	dev.send(formatHexCommand(Async, []byte{0xda, 0xed, 0, 2}))
+	<-out
+	eq(t, 0, len(errs))
+	eq(t, 3, len(all))
+
+	eq(t, ErrNoAsyncUpdatesRegister, v.SetAsyncUpdates(context.Background(), false))
+}
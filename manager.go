@@ -0,0 +1,265 @@
+package vedirect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// DeviceKeyField is added by a Manager to each record, the key of the device it came from
+const DeviceKeyField = "_d"
+
+var ErrUnknownDevice = errors.New("vedirect unknown device key")
+
+// Manager reads several devices and merges their records into one stream.
+//
+// Each record gets a DeviceKeyField: the device's serial number ("SER#") once one has been seen, otherwise the port path.
+// BMV and SmartShunt text frames have no serial number, so they are known by path.
+type Manager struct {
+	out  chan<- map[string]string
+	opts Options
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// forwarding threads, out is closed after they're done
+	wg   sync.WaitGroup
+	done chan struct{}
+
+	// l protects ports and devices
+	l       sync.Mutex
+	ports   []*managedPort
+	devices map[string]*managedPort
+}
+
+type managedPort struct {
+	path string
+	v    *Vedirect
+
+	// key is the serial number or path
+	key string
+
+	// serial number the port was last keyed by
+	serial string
+
+	// latest value of each field
+	state map[string]string
+}
+
+// NewManager starts a Manager sending to out.
+// opts are used for each device opened; opts.Context stops all of them, opts.WaitGroup is Done when out is closed.
+func NewManager(out chan<- map[string]string, opts Options) *Manager {
+	m := &Manager{
+		out:     out,
+		opts:    opts,
+		devices: make(map[string]*managedPort),
+		done:    make(chan struct{}),
+	}
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	m.ctx, m.cancel = context.WithCancel(ctx)
+	m.opts.Context = m.ctx
+	m.opts.WaitGroup = nil
+	if opts.WaitGroup != nil {
+		opts.WaitGroup.Add(1)
+	}
+	// hold out open until Close
+	m.wg.Add(1)
+	go func() {
+		<-m.ctx.Done()
+		m.l.Lock()
+		m.wg.Done()
+		m.l.Unlock()
+		m.wg.Wait()
+		close(m.out)
+		close(m.done)
+		if opts.WaitGroup != nil {
+			opts.WaitGroup.Done()
+		}
+	}()
+	return m
+}
+
+// Open a device path as with OpenWithOptions and add it to the Manager
+func (m *Manager) Open(path string) error {
+	// don't open a second reader of the port, add checks again
+	m.l.Lock()
+	err := m.checkNewPath(path)
+	m.l.Unlock()
+	if err != nil {
+		return err
+	}
+	portChan := make(chan map[string]string, 10)
+	v, err := OpenWithOptions(path, portChan, m.opts)
+	if err != nil {
+		return err
+	}
+	return m.add(path, v, portChan)
+}
+
+// Add a device on rw as with New, known as path until it reports a serial number
+func (m *Manager) Add(path string, rw io.ReadWriter) error {
+	portChan := make(chan map[string]string, 10)
+	v := New(rw, portChan, m.opts)
+	return m.add(path, v, portChan)
+}
+
+func (m *Manager) add(path string, v *Vedirect, portChan <-chan map[string]string) error {
+	mp := &managedPort{path: path, v: v, key: path, state: make(map[string]string)}
+	m.l.Lock()
+	defer m.l.Unlock()
+	if err := m.checkNewPath(path); err != nil {
+		v.Close()
+		return err
+	}
+	m.ports = append(m.ports, mp)
+	m.devices[path] = mp
+	m.wg.Add(1)
+	go m.forward(mp, portChan)
+	return nil
+}
+
+func (m *Manager) forward(mp *managedPort, portChan <-chan map[string]string) {
+	defer m.wg.Done()
+	for rec := range portChan {
+		m.l.Lock()
+		if serial := rec["SER#"]; serial != "" && serial != mp.serial {
+			mp.serial = serial
+			m.rekey(mp, serial)
+		}
+		for k, v := range rec {
+			mp.state[k] = v
+		}
+		rec[DeviceKeyField] = mp.key
+		m.l.Unlock()
+		select {
+		case m.out <- rec:
+		case <-m.ctx.Done():
+		}
+	}
+}
+
+// checkNewPath errs if the Manager is closed or already has path, l must be held
+func (m *Manager) checkNewPath(path string) error {
+	if m.ctx.Err() != nil {
+		return ErrClosed
+	}
+	// ports, not devices, which has the serial number once one is reported
+	for _, mp := range m.ports {
+		if mp.path == path {
+			return fmt.Errorf("vedirect %#v already added", path)
+		}
+	}
+	return nil
+}
+
+// rekey moves mp to a new key, l must be held
+func (m *Manager) rekey(mp *managedPort, key string) {
+	if m.devices[mp.key] == mp {
+		delete(m.devices, mp.key)
+	}
+	if other, ok := m.devices[key]; ok && other != mp {
+		// two ports with one serial number, keep them apart
+		key = fmt.Sprintf("%s@%s", key, mp.path)
+	}
+	mp.key = key
+	m.devices[key] = mp
+}
+
+// Keys of the devices, sorted
+func (m *Manager) Keys() []string {
+	m.l.Lock()
+	defer m.l.Unlock()
+	keys := make([]string, 0, len(m.devices))
+	for key := range m.devices {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// device finds a port by key or path, l must be held
+func (m *Manager) device(key string) (*managedPort, error) {
+	if mp, ok := m.devices[key]; ok {
+		return mp, nil
+	}
+	// a port is still known by path after it reports a serial number
+	for _, p := range m.ports {
+		if p.path == key {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("%w %#v", ErrUnknownDevice, key)
+}
+
+// Device returns the Vedirect for a device key (serial number or path), e.g. for HEX commands
+func (m *Manager) Device(key string) (*Vedirect, error) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	mp, err := m.device(key)
+	if err != nil {
+		return nil, err
+	}
+	return mp.v, nil
+}
+
+// State returns the latest value of every field received from a device, by key or path
+func (m *Manager) State(key string) (map[string]string, error) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	mp, err := m.device(key)
+	if err != nil {
+		return nil, err
+	}
+	state := make(map[string]string, len(mp.state))
+	for k, v := range mp.state {
+		state[k] = v
+	}
+	return state, nil
+}
+
+// GetRegister of a device, see Vedirect.GetRegister
+func (m *Manager) GetRegister(ctx context.Context, key string, addr uint16) (*VERegValue, error) {
+	v, err := m.Device(key)
+	if err != nil {
+		return nil, err
+	}
+	return v.GetRegister(ctx, addr)
+}
+
+// SetRegister of a device, see Vedirect.SetRegister
+func (m *Manager) SetRegister(ctx context.Context, key string, reg VERegister, value any) (*VERegValue, error) {
+	v, err := m.Device(key)
+	if err != nil {
+		return nil, err
+	}
+	return v.SetRegister(ctx, reg, value)
+}
+
+// SendHexCommand to a device, see Vedirect.SendHexCommand
+func (m *Manager) SendHexCommand(key string, cmd Command, msg []byte) error {
+	v, err := m.Device(key)
+	if err != nil {
+		return err
+	}
+	return v.SendHexCommand(cmd, msg)
+}
+
+// Close all devices, then close out
+func (m *Manager) Close() error {
+	m.cancel()
+	m.l.Lock()
+	ports := make([]*managedPort, len(m.ports))
+	copy(ports, m.ports)
+	m.l.Unlock()
+	for _, mp := range ports {
+		mp.v.Close()
+	}
+	<-m.done
+	return nil
+}
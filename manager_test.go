@@ -0,0 +1,92 @@
+package vedirect
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestManager(t *testing.T) {
+	out := make(chan map[string]string, 10)
+	m := NewManager(out, Options{HexTimeout: 50 * time.Millisecond})
+
+	mppt := newTestDevice(map[uint16][]byte{0xedf0: {0x96, 0x00}})
+	err := m.Add("/dev/ttyUSB0", mppt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mppt.send(testFrame("PID", "0xA053", "SER#", "HQ1234ABCDE", "V", "13820"))
+	rec := <-out
+	eq(t, "HQ1234ABCDE", rec[DeviceKeyField])
+	eq(t, "13820", rec["V"])
+
+	shunt := &testRW{Reader: bytes.NewReader(testFrame("PID", "0xA389", "V", "13010", "I", "-500"))}
+	err = m.Add("/dev/ttyUSB1", shunt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = <-out
+	eq(t, "/dev/ttyUSB1", rec[DeviceKeyField])
+	eq(t, "-500", rec["I"])
+
+	eq(t, "[/dev/ttyUSB1 HQ1234ABCDE]", fmt.Sprint(m.Keys()))
+	state, err := m.State("/dev/ttyUSB1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq(t, "13010", state["V"])
+
+	// later records merge into state
+	mppt.send(testFrame("PID", "0xA053", "SER#", "HQ1234ABCDE", "V", "13830", "PPV", "42"))
+	rec = <-out
+	eq(t, "HQ1234ABCDE", rec[DeviceKeyField])
+	state, _ = m.State("HQ1234ABCDE")
+	eq(t, "13830", state["V"])
+	eq(t, "42", state["PPV"])
+
+	ctx := context.Background()
+	rv, err := m.GetRegister(ctx, "HQ1234ABCDE", 0xedf0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq(t, uint16(150), rv.Value)
+	// still known by path for HEX commands
+	_, err = m.Device("/dev/ttyUSB0")
+	eq(t, nil, err)
+	// still added after it is known by serial number
+	eq(t, true, m.Add("/dev/ttyUSB0", &testRW{Reader: bytes.NewReader(nil)}) != nil)
+	eq(t, true, m.Open("/dev/ttyUSB0") != nil)
+	state, err = m.State("/dev/ttyUSB0")
+	eq(t, nil, err)
+	eq(t, "13830", state["V"])
+
+	// a second port with the same serial number keeps its own key
+	twin := newTestDevice(nil)
+	err = m.Add("/dev/ttyUSB3", twin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		twin.send(testFrame("PID", "0xA053", "SER#", "HQ1234ABCDE", "V", "12000"))
+		rec = <-out
+		eq(t, "HQ1234ABCDE@/dev/ttyUSB3", rec[DeviceKeyField])
+	}
+	eq(t, "[/dev/ttyUSB1 HQ1234ABCDE HQ1234ABCDE@/dev/ttyUSB3]", fmt.Sprint(m.Keys()))
+	state, _ = m.State("HQ1234ABCDE")
+	eq(t, "13830", state["V"])
+
+	_, err = m.GetRegister(ctx, "HQ0000", 0xedf0)
+	eq(t, true, errors.Is(err, ErrUnknownDevice))
+	_, err = m.State("HQ0000")
+	eq(t, true, errors.Is(err, ErrUnknownDevice))
+
+	mppt.Close()
+	twin.Close()
+	m.Close()
+	for range out {
+	}
+	eq(t, ErrClosed, m.Add("/dev/ttyUSB2", &testRW{Reader: bytes.NewReader(nil)}))
+}
@@ -0,0 +1,273 @@
+package vedirect
+
+import (
+	ehex "encoding/hex"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// internedKeys maps each known field name to itself, so parsed records share one string per name
+var internedKeys map[string]string
+
+// limit on unknown field names remembered per Vedirect, line noise could make any number of them
+const maxUnknownKeys = 64
+
+// called by init after IntFields and OtherFields are built
+func initInternedKeys() {
+	internedKeys = make(map[string]string, len(IntFields)+len(OtherFields)+1)
+	for k := range IntFields {
+		internedKeys[k] = k
+	}
+	for k := range OtherFields {
+		internedKeys[k] = k
+	}
+}
+
+// RecordPool recycles record maps, see Options.RecordPool
+type RecordPool struct {
+	pool sync.Pool
+}
+
+// Get an empty record
+func (rp *RecordPool) Get() map[string]string {
+	rec, _ := rp.pool.Get().(map[string]string)
+	if rec == nil {
+		rec = make(map[string]string, 32)
+	}
+	return rec
+}
+
+// Put a record back for reuse. Nothing may use it afterwards.
+func (rp *RecordPool) Put(rec map[string]string) {
+	for k := range rec {
+		delete(rec, k)
+	}
+	rp.pool.Put(rec)
+}
+
+func (v *Vedirect) newRecord(size int) map[string]string {
+	if v.opts.RecordPool != nil {
+		return v.opts.RecordPool.Get()
+	}
+	return make(map[string]string, size)
+}
+
+func (v *Vedirect) putRecord(rec map[string]string) {
+	if v.opts.RecordPool != nil {
+		v.opts.RecordPool.Put(rec)
+	}
+}
+
+// handleBytes parses a buffer read from the device.
+// Runs of key, value and HEX bytes are appended at once, everything else goes through handle.
+func (v *Vedirect) handleBytes(buf []byte) {
+	for len(buf) > 0 {
+		var stop byte
+		switch v.state {
+		case inKey:
+			stop = delimiter
+		case inValue:
+			stop = '\r'
+		case hex:
+			stop = '\n'
+		default:
+			v.handle(buf[0])
+			buf = buf[1:]
+			continue
+		}
+		n := 0
+		if v.state == inKey {
+			for n < len(buf) && buf[n] != stop && buf[n] != hexmarker && buf[n] != '\r' && buf[n] != '\n' {
+				n++
+			}
+		} else {
+			for n < len(buf) && buf[n] != stop && buf[n] != hexmarker {
+				n++
+			}
+		}
+		if n == 0 {
+			v.handle(buf[0])
+			buf = buf[1:]
+			continue
+		}
+		run := buf[:n]
+		buf = buf[n:]
+		switch v.state {
+		case inKey:
+			v.key = append(v.key, run...)
+		case inValue:
+			v.value = append(v.value, run...)
+		case hex:
+			// not part of the text checksum
+			v.hexMessage = append(v.hexMessage, run...)
+			continue
+		}
+		for _, c := range run {
+			v.bytesSum += uint(c)
+		}
+	}
+}
+
+// handle achieves parsing VE.Direct status messages
+// lines are mostly text except Checksum byte:
+// "\r\n{key}\t{value}"
+// "\r\nChecksum\t{cs byte}"
+// {cs byte} + {all bytes through "\r\n" after previous csbyte} == 0x00
+//
+// HEX protocol line:
+// :{command nybble}{[xx] hex bytes...}{cs byte}\n
+// 0x0{command nybble} + bytes + cs byte == 0x55
+//
+// A HEX line may come in the middle of a text block (e.g. an async update).
+// It is not part of the text checksum, and the text block resumes after it.
+func (v *Vedirect) handle(b uint8) {
+	if b == hexmarker && v.state != inChecksum {
+		if v.state != hex {
+			v.textState = v.state
+		}
+		v.state = hex
+		v.hexMessage = append(v.hexMessage[:0], '0') // prefix for command nybble
+		return
+	}
+
+	if v.state == hex {
+		if b == '\n' {
+			v.finishHexMessage()
+			v.state = v.textState
+		} else {
+			// accumulate nybbles, parse at end
+			v.hexMessage = append(v.hexMessage, b)
+		}
+		return
+	}
+
+	v.bytesSum += uint(b)
+	switch v.state {
+	case waitHeader:
+		if b == '\n' {
+			v.state = inKey
+		}
+	case inKey:
+		if b == '\r' || b == '\n' {
+			// no key has these, line start after a HEX line
+			v.key = v.key[:0]
+		} else if b == delimiter {
+			if string(v.key) == "Checksum" {
+				v.state = inChecksum
+			} else {
+				v.state = inValue
+			}
+		} else {
+			v.key = append(v.key, b)
+		}
+	case inValue:
+		if b == '\r' {
+			v.state = waitHeader
+			if v.data == nil {
+				v.data = v.newRecord(v.recordSize)
+			}
+			key := v.internKey(v.key)
+			v.data[key] = v.internValue(key, v.value)
+			v.key = v.key[:0]
+			v.value = v.value[:0]
+		} else {
+			v.value = append(v.value, b)
+		}
+	case inChecksum:
+		v.key = v.key[:0]
+		v.value = v.value[:0]
+		v.state = waitHeader
+		if v.bytesSum%256 == 0 {
+			v.countFrame(&v.stats.Frames)
+			if v.data != nil {
+				// room for "_t" too
+				v.recordSize = len(v.data) + 1
+				v.textBlock(v.data)
+			}
+		} else {
+			v.countError(&v.stats.ChecksumErrors)
+			v.debug("bad text checksum, dropped %d fields", len(v.data))
+			if v.data != nil {
+				v.putRecord(v.data)
+			}
+		}
+		v.data = nil
+		v.bytesSum = 0
+	default:
+		panic("bad state")
+	}
+}
+
+// internKey returns the field name as a string without allocating for known or already seen names
+func (v *Vedirect) internKey(key []byte) string {
+	if k, ok := internedKeys[string(key)]; ok {
+		return k
+	}
+	if k, ok := v.keys[string(key)]; ok {
+		return k
+	}
+	k := string(key)
+	if v.keys == nil {
+		v.keys = make(map[string]string)
+	}
+	if len(v.keys) < maxUnknownKeys {
+		v.keys[k] = k
+	}
+	return k
+}
+
+// internValue reuses the previous value of the field if it hasn't changed
+func (v *Vedirect) internValue(key string, value []byte) string {
+	if prev, ok := v.values[key]; ok && prev == string(value) {
+		return prev
+	}
+	s := string(value)
+	if v.values == nil {
+		v.values = make(map[string]string, len(internedKeys))
+	}
+	if len(v.values) < len(internedKeys)+maxUnknownKeys {
+		v.values[key] = s
+	}
+	return s
+}
+
+func (v *Vedirect) finishHexMessage() {
+	blen := len(v.hexMessage) / 2
+	if cap(v.hexBytes) < blen {
+		v.hexBytes = make([]byte, blen)
+	}
+	hbytes := v.hexBytes[:blen]
+	count, err := ehex.Decode(hbytes, v.hexMessage)
+	if err != nil {
+		v.countError(&v.stats.HexErrors)
+		v.debug("bad HEX message, %v", err)
+		v.debug("hexbyte: %s", ehex.EncodeToString(v.hexMessage))
+		return
+	}
+	var hexSum uint
+	for _, c := range hbytes[:count] {
+		hexSum += uint(c)
+	}
+	if hexSum&0x0ff != 0x055 {
+		v.countError(&v.stats.HexErrors)
+		v.debug("bad HEX checksum, 0x%02x != 0x55", hexSum&0x0ff)
+		return
+	}
+	v.countFrame(&v.stats.HexFrames)
+	if v.deliverHex(hbytes[:count]) {
+		return
+	}
+	if hbytes[0] == byte(Async) {
+		v.publishAsync(hbytes[:count])
+	}
+	data := v.newRecord(2)
+	if v.AddTime {
+		data["_t"] = strconv.FormatInt(time.Now().UnixMilli(), 10)
+	}
+	if v.lastHex != string(v.hexMessage) {
+		v.lastHex = string(v.hexMessage)
+	}
+	data["_x"] = v.lastHex
+	v.emit(data)
+}
@@ -0,0 +1,227 @@
+package vedirect
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// a second of MPPT output: a text frame and an async HEX update
+func benchStream(frames int) []byte {
+	var stream []byte
+	for i := 0; i < frames; i++ {
+		v := "1382" + string(rune('0'+i%10))
+		stream = append(stream, testFrame(
+			"PID", "0xA053", "FW", "159", "SER#", "HQ1234ABCDE",
+			"V", v, "I", "2100", "VPV", "36010", "PPV", "29",
+			"CS", "3", "MPPT", "2", "OR", "0x00000000", "ERR", "0",
+			"LOAD", "ON", "IL", "0", "H19", "10283", "H20", "12",
+			"H21", "87", "H22", "15", "H23", "95", "HSDS", "192")...)
+		stream = append(stream, formatHexCommand(Async, []byte{0xbb, 0xed, 0x00, 0x10, 0x27})...)
+	}
+	return stream
+}
+
+func benchmarkReader(b *testing.B, opts Options, put bool) {
+	stream := benchStream(100)
+	b.SetBytes(int64(len(stream)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		out := make(chan map[string]string, 10)
+		NewReader(bytes.NewReader(stream), out, opts)
+		for rec := range out {
+			if put {
+				opts.RecordPool.Put(rec)
+			}
+		}
+	}
+}
+
+func BenchmarkReader(b *testing.B) {
+	benchmarkReader(b, Options{}, false)
+}
+
+func BenchmarkReaderPool(b *testing.B) {
+	benchmarkReader(b, Options{RecordPool: new(RecordPool)}, true)
+}
+
+// parse whole buffers without the read thread
+func BenchmarkHandleBytes(b *testing.B) {
+	stream := benchStream(100)
+	out := make(chan map[string]string, 1)
+	pool := new(RecordPool)
+	v := newVedirect(out, Options{RecordPool: pool})
+	go func() {
+		for rec := range out {
+			pool.Put(rec)
+		}
+	}()
+	b.SetBytes(int64(len(stream)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for buf := stream; len(buf) > 0; {
+			n := 4096
+			if n > len(buf) {
+				n = len(buf)
+			}
+			v.handleBytes(buf[:n])
+			buf = buf[n:]
+		}
+	}
+	b.StopTimer()
+	close(out)
+}
+
+// parse with handleBytes split at every offset, and byte at a time, and compare
+func TestHandleBytesSplit(t *testing.T) {
+	var stream []byte
+	stream = append(stream, testFrame("PID", "0xA053", "V", "13820", "Unknown", "x")...)
+	stream = append(stream, formatHexCommand(Async, []byte{0xbb, 0xed, 0x00, 0x10, 0x27})...)
+	bad := testFrame("PID", "0xA053", "V", "13830")
+	bad[len(bad)-1]++
+	stream = append(stream, bad...)
+	stream = append(stream, testFrame("PID", "0xA053", "V", "13840", "Unknown", "x")...)
+	stream = append(stream, ":A00\n"...) // bad HEX checksum
+	stream = append(stream, testFrame("PID", "0xA053", "V", "13840", "Unknown", "y")...)
+
+	parse := func(chunks ...[]byte) ([]map[string]string, Stats) {
+		out := make(chan map[string]string, 20)
+		v := newVedirect(out, Options{})
+		for _, chunk := range chunks {
+			v.handleBytes(chunk)
+		}
+		close(out)
+		return readAll(out), v.Stats()
+	}
+	expected, expectedStats := parse(stream)
+	eq(t, 4, len(expected))
+	eq(t, "0ABBED0010276C", expected[1]["_x"])
+	eq(t, "13840", expected[2]["V"])
+	eq(t, "y", expected[3]["Unknown"])
+	eq(t, int64(1), expectedStats.ChecksumErrors)
+	eq(t, int64(1), expectedStats.HexErrors)
+	for i := 1; i < len(stream); i++ {
+		recs, stats := parse(stream[:i], stream[i:])
+		eq(t, fmt.Sprint(expected), fmt.Sprint(recs))
+		eq(t, expectedStats.Frames, stats.Frames)
+	}
+	chunks := make([][]byte, len(stream))
+	for i := range stream {
+		chunks[i] = stream[i : i+1]
+	}
+	recs, _ := parse(chunks...)
+	eq(t, fmt.Sprint(expected), fmt.Sprint(recs))
+}
+
+func TestRecordPool(t *testing.T) {
+	pool := new(RecordPool)
+	stream := benchStream(3)
+	out := make(chan map[string]string, 10)
+	NewReader(bytes.NewReader(stream), out, Options{RecordPool: pool, MergeBlocks: true})
+	count := 0
+	for rec := range out {
+		if rec["_x"] == "" {
+			eq(t, "HQ1234ABCDE", rec["SER#"])
+			eq(t, 19, len(rec))
+		}
+		count++
+		pool.Put(rec)
+	}
+	eq(t, 6, count)
+	eq(t, 0, len(pool.Get()))
+}
+
+// an async HEX line at every point in a text frame before the checksum byte
+func TestHexInTextFrame(t *testing.T) {
+	frame := testFrame("PID", "0xA053", "FW", "159", "V", "13820", "I", "2100")
+	async := formatHexCommand(Async, []byte{0xbb, 0xed, 0x00, 0x10, 0x27})
+	for i := 0; i < len(frame)-1; i++ {
+		var stream []byte
+		stream = append(stream, frame[:i]...)
+		stream = append(stream, async...)
+		stream = append(stream, frame[i:]...)
+		// and the next frame is unaffected
+		stream = append(stream, frame...)
+		out := make(chan map[string]string, 10)
+		v := newVedirect(out, Options{})
+		v.handleBytes(stream)
+		close(out)
+		recs := readAll(out)
+		if len(recs) != 3 {
+			t.Fatalf("hex at %d: %d records %v", i, len(recs), recs)
+		}
+		eq(t, "0ABBED0010276C", recs[0]["_x"])
+		for _, rec := range recs[1:] {
+			eq(t, "13820", rec["V"])
+			eq(t, "2100", rec["I"])
+			eq(t, 4, len(rec))
+		}
+		stats := v.Stats()
+		eq(t, int64(2), stats.Frames)
+		eq(t, int64(0), stats.ChecksumErrors)
+		eq(t, int64(1), stats.HexFrames)
+	}
+}
+
+// test vectors: HEX lines between and inside text frames, as devices send them
+func TestInterleavedStreams(t *testing.T) {
+	cases := []struct {
+		name   string
+		stream string
+		expect string
+	}{
+		{
+			"hex between lines",
+			"\r\nPID\t0xA053\r\nV\t13820:ABBED0010276C\n\r\nI\t100\r\nChecksum\t",
+			"[map[_x:0ABBED0010276C] map[I:100 PID:0xA053 V:13820]]",
+		},
+		{
+			"hex after line start",
+			"\r\nPID\t0xA053\r\n:ABBED0010276C\nV\t13820\r\nChecksum\t",
+			"[map[_x:0ABBED0010276C] map[PID:0xA053 V:13820]]",
+		},
+		{
+			"two hex lines",
+			"\r\nPID\t0xA053\r\nV\t138:ABBED0010276C\n:51641F9\n20\r\nChecksum\t",
+			"[map[_x:0ABBED0010276C] map[_x:051641F9] map[PID:0xA053 V:13820]]",
+		},
+		{
+			"hex restarts hex",
+			"\r\nPID\t0xA053\r\nV\t13820:ABBE:51641F9\n\r\nChecksum\t",
+			"[map[_x:051641F9] map[PID:0xA053 V:13820]]",
+		},
+		{
+			// checksum byte is ':', not a HEX line
+			"colon checksum byte",
+			"\r\nPID\t0xA053\r\nSER#\tHQeee\r\nChecksum\t",
+			"[map[PID:0xA053 SER#:HQeee]]",
+		},
+	}
+	for _, tc := range cases {
+		stream := []byte(tc.stream)
+		var sum byte
+		for i := 0; i < len(stream); {
+			if stream[i] == ':' {
+				// HEX lines aren't in the checksum
+				end := bytes.IndexByte(stream[i:], '\n')
+				next := bytes.IndexByte(stream[i+1:], ':')
+				if next >= 0 && next+1 < end {
+					end = next + 1
+				} else {
+					end++
+				}
+				i += end
+				continue
+			}
+			sum += stream[i]
+			i++
+		}
+		stream = append(stream, -sum)
+		recs := parseStream(stream)
+		eq(t, tc.expect, fmt.Sprint(recs))
+		if t.Failed() {
+			t.Fatalf("case %s", tc.name)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package vedirect
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// Record is a typed VE.Direct text protocol record.
+//
+// Field names are the VE.Direct labels (where they are valid Go names) and units are those listed in IntFields.
+// Numeric fields are nil when the device did not send them, text fields are "".
+// Which fields are present varies a lot by product, an MPPT sends PPV but not SOC, a BMV sends SOC but not PPV.
+type Record struct {
+	// Time is "_t", unix milliseconds when the record was received (if AddTime)
+	Time *int64 `ve:"_t"`
+
+	V    *int64 `ve:"V"`    // mV, main or channel 1 battery voltage
+	V2   *int64 `ve:"V2"`   // mV, channel 2 battery voltage
+	V3   *int64 `ve:"V3"`   // mV, channel 3 battery voltage
+	VS   *int64 `ve:"VS"`   // mV, auxiliary (starter) voltage
+	VM   *int64 `ve:"VM"`   // mV, mid-point voltage of the battery bank
+	DM   *int64 `ve:"DM"`   // ‰, mid-point deviation of the battery bank
+	VPV  *int64 `ve:"VPV"`  // mV, panel voltage
+	PPV  *int64 `ve:"PPV"`  // W, panel power
+	I    *int64 `ve:"I"`    // mA, main or channel 1 battery current
+	I2   *int64 `ve:"I2"`   // mA, channel 2 battery current
+	I3   *int64 `ve:"I3"`   // mA, channel 3 battery current
+	IL   *int64 `ve:"IL"`   // mA, load current
+	T    *int64 `ve:"T"`    // °C, battery temperature
+	P    *int64 `ve:"P"`    // W, instantaneous power
+	CE   *int64 `ve:"CE"`   // mAh, consumed amp hours
+	SOC  *int64 `ve:"SOC"`  // ‰, state of charge
+	TTG  *int64 `ve:"TTG"`  // minutes, time to go
+	HSDS *int64 `ve:"HSDS"` // day sequence number (0..364)
+
+	// History counters, meaning depends on product (BMV vs MPPT)
+	H1  *int64 `ve:"H1"`  // mAh, depth of the deepest discharge
+	H2  *int64 `ve:"H2"`  // mAh, depth of the last discharge
+	H3  *int64 `ve:"H3"`  // mAh, depth of the average discharge
+	H4  *int64 `ve:"H4"`  // number of charge cycles
+	H5  *int64 `ve:"H5"`  // number of full discharges
+	H6  *int64 `ve:"H6"`  // mAh, cumulative amp hours drawn
+	H7  *int64 `ve:"H7"`  // mV, minimum main battery voltage
+	H8  *int64 `ve:"H8"`  // mV, maximum main battery voltage
+	H9  *int64 `ve:"H9"`  // seconds since last full charge
+	H10 *int64 `ve:"H10"` // number of automatic synchronizations
+	H11 *int64 `ve:"H11"` // number of low main voltage alarms
+	H12 *int64 `ve:"H12"` // number of high main voltage alarms
+	H13 *int64 `ve:"H13"` // number of low auxiliary voltage alarms
+	H14 *int64 `ve:"H14"` // number of high auxiliary voltage alarms
+	H15 *int64 `ve:"H15"` // mV, minimum auxiliary voltage
+	H16 *int64 `ve:"H16"` // mV, maximum auxiliary voltage
+	H17 *int64 `ve:"H17"` // 0.01kWh, amount of discharged energy
+	H18 *int64 `ve:"H18"` // 0.01kWh, amount of charged energy
+	H19 *int64 `ve:"H19"` // 0.01kWh, yield total (user resettable counter)
+	H20 *int64 `ve:"H20"` // 0.01kWh, yield today
+	H21 *int64 `ve:"H21"` // W, maximum power today
+	H22 *int64 `ve:"H22"` // 0.01kWh, yield yesterday
+	H23 *int64 `ve:"H23"` // W, maximum power yesterday
+
+	ACOutV *int64 `ve:"AC_OUT_V"` // 0.01V, AC output voltage
+	ACOutI *int64 `ve:"AC_OUT_I"` // 0.1A, AC output current
+	ACOutS *int64 `ve:"AC_OUT_S"` // VA, AC output apparent power
+
+	Load   string `ve:"LOAD"`  // load output state (ON/OFF)
+	Alarm  string `ve:"Alarm"` // alarm condition active (ON/OFF)
+	Relay  string `ve:"Relay"` // relay state (ON/OFF)
+	AR     string `ve:"AR"`    // alarm reason
+	OR     string `ve:"OR"`    // off reason
+	ERR    string `ve:"ERR"`   // error code
+	CS     string `ve:"CS"`    // state of operation
+	BMV    string `ve:"BMV"`   // model description (deprecated)
+	FW     string `ve:"FW"`    // firmware version (16 bit)
+	FWE    string `ve:"FWE"`   // firmware version (24 bit)
+	PID    string `ve:"PID"`   // product ID
+	Serial string `ve:"SER#"`  // serial number
+	Mode   string `ve:"MODE"`  // device mode
+	Warn   string `ve:"WARN"`  // warning reason
+	MPPT   string `ve:"MPPT"`  // tracker operation mode
+	MON    string `ve:"MON"`   // DC monitor mode
+
+	// Hex is a HEX protocol message received between text frames, see SendHexCommand
+	Hex string `ve:"_x"`
+
+	// Conn is a ConnState change from a Vedirect with Options.Reconnect
+	Conn string `ve:"_c"`
+
+	// Device is the device key added by a Manager, see DeviceKeyField
+	Device string `ve:"_d"`
+
+	// Unknown holds any fields not known to IntFields or OtherFields
+	Unknown map[string]string `json:"-"`
+}
+
+// VE.Direct label to index of field in Record
+var recordFieldIndex map[string]int
+
+func init() {
+	rt := reflect.TypeOf(Record{})
+	recordFieldIndex = make(map[string]int, rt.NumField())
+	for i := 0; i < rt.NumField(); i++ {
+		tag := rt.Field(i).Tag.Get("ve")
+		if tag != "" {
+			recordFieldIndex[tag] = i
+		}
+	}
+}
+
+var int64PtrType = reflect.TypeOf((*int64)(nil))
+
+// DecodeRecord converts a record as received from Vedirect into a Record.
+//
+// Values are parsed by ParseRecordFieldString.
+// On a bad value the rest of the record is still decoded, the bad value is kept in Unknown, and the first error is returned.
+func DecodeRecord(rec map[string]string) (*Record, error) {
+	out := new(Record)
+	var firstErr error
+	rv := reflect.ValueOf(out).Elem()
+	for k, v := range rec {
+		fi, known := recordFieldIndex[k]
+		if !known {
+			out.setUnknown(k, v)
+			continue
+		}
+		field := rv.Field(fi)
+		pv := ParseRecordFieldString(k, v)
+		switch tv := pv.(type) {
+		case int64:
+			if field.Type() == int64PtrType {
+				field.Set(reflect.ValueOf(&tv))
+			} else {
+				out.setUnknown(k, v)
+			}
+		case string:
+			if field.Kind() == reflect.String {
+				field.SetString(tv)
+			} else {
+				out.setUnknown(k, v)
+				if firstErr == nil {
+					firstErr = fmt.Errorf("record field %s: bad int %#v", k, v)
+				}
+			}
+		}
+	}
+	return out, firstErr
+}
+
+func (r *Record) setUnknown(k, v string) {
+	if r.Unknown == nil {
+		r.Unknown = make(map[string]string)
+	}
+	r.Unknown[k] = v
+}
+
+// Has returns true if the VE.Direct field k is present in the record.
+func (r *Record) Has(k string) bool {
+	fi, known := recordFieldIndex[k]
+	if !known {
+		_, has := r.Unknown[k]
+		return has
+	}
+	field := reflect.ValueOf(r).Elem().Field(fi)
+	if field.Kind() == reflect.String {
+		return field.String() != ""
+	}
+	return !field.IsNil()
+}
+
+// Map converts back to the map form delivered by Vedirect.
+func (r *Record) Map() map[string]string {
+	out := make(map[string]string, len(recordFieldIndex)+len(r.Unknown))
+	rv := reflect.ValueOf(r).Elem()
+	for k, fi := range recordFieldIndex {
+		field := rv.Field(fi)
+		if field.Kind() == reflect.String {
+			if field.String() != "" {
+				out[k] = field.String()
+			}
+		} else if !field.IsNil() {
+			out[k] = strconv.FormatInt(field.Elem().Int(), 10)
+		}
+	}
+	for k, v := range r.Unknown {
+		out[k] = v
+	}
+	return out
+}
+
+// Parsed returns the same thing as ParseRecord(r.Map())
+func (r *Record) Parsed() map[string]interface{} {
+	return ParseRecord(r.Map())
+}
+
+// MarshalJSON writes the same JSON object as for ParseRecord() output.
+func (r *Record) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.Parsed())
+}
+
+// UnmarshalJSON reads a JSON object of either string or number values, e.g. from ParseRecord() output or a raw record.
+func (r *Record) UnmarshalJSON(blob []byte) error {
+	var they map[string]interface{}
+	err := json.Unmarshal(blob, &they)
+	if err != nil {
+		return err
+	}
+	rec := make(map[string]string, len(they))
+	for k, v := range they {
+		switch tv := v.(type) {
+		case string:
+			rec[k] = tv
+		case float64:
+			rec[k] = strconv.FormatFloat(tv, 'f', -1, 64)
+		default:
+			return fmt.Errorf("record field %s: unexpected json %T", k, v)
+		}
+	}
+	nr, err := DecodeRecord(rec)
+	if nr != nil {
+		*r = *nr
+	}
+	return err
+}
+
+// DecodeRecords reads map records from in, such as the output channel of Vedirect, and writes decoded Record to out.
+// Records are passed on even if some fields had errors, bad values are kept in Record.Unknown.
+// When in is closed, out is closed.
+func DecodeRecords(in <-chan map[string]string, out chan<- *Record) {
+	defer close(out)
+	for rec := range in {
+		nr, _ := DecodeRecord(rec)
+		out <- nr
+	}
+}
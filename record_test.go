@@ -0,0 +1,101 @@
+package vedirect
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestRecordFieldsKnown(t *testing.T) {
+	// every known field should have a place in Record, and int-ness should agree
+	for k := range IntFields {
+		fi, ok := recordFieldIndex[k]
+		if !ok {
+			t.Errorf("IntFields[%#v] has no Record field", k)
+			continue
+		}
+		ptype := reflect.TypeOf(Record{}).Field(fi).Type
+		if ptype != int64PtrType {
+			t.Errorf("IntFields[%#v] Record field is %v", k, ptype)
+		}
+	}
+	for k := range OtherFields {
+		if _, ok := recordFieldIndex[k]; !ok {
+			t.Errorf("OtherFields[%#v] has no Record field", k)
+		}
+	}
+}
+
+func TestDecodeRecord(t *testing.T) {
+	raw := map[string]string{
+		"PID":  "0xA053",
+		"V":    "13820",
+		"I":    "-1200",
+		"PPV":  "0",
+		"CS":   "3",
+		"SER#": "HQ2132ABCDE",
+		"WAT":  "huh",
+		"_t":   "1665000000123",
+	}
+	rec, err := DecodeRecord(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.V == nil || *rec.V != 13820 {
+		t.Errorf("V got %#v", rec.V)
+	}
+	if rec.I == nil || *rec.I != -1200 {
+		t.Errorf("I got %#v", rec.I)
+	}
+	if rec.PPV == nil || *rec.PPV != 0 {
+		t.Errorf("PPV got %#v", rec.PPV)
+	}
+	if rec.SOC != nil {
+		t.Errorf("SOC got %#v", rec.SOC)
+	}
+	eq(t, "3", rec.CS)
+	eq(t, "HQ2132ABCDE", rec.Serial)
+	eq(t, "huh", rec.Unknown["WAT"])
+	eq(t, true, rec.Has("PPV"))
+	eq(t, false, rec.Has("SOC"))
+	eq(t, true, rec.Has("WAT"))
+
+	back := rec.Map()
+	if len(back) != len(raw) {
+		t.Errorf("Map() len %d, wanted %d", len(back), len(raw))
+	}
+	for k, v := range raw {
+		if back[k] != v {
+			t.Errorf("Map()[%#v] = %#v, wanted %#v", k, back[k], v)
+		}
+	}
+
+	blob, err := json.Marshal(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pblob, _ := json.Marshal(ParseRecord(raw))
+	eq(t, string(pblob), string(blob))
+
+	var jrec Record
+	err = json.Unmarshal(blob, &jrec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jrec.Time == nil || *jrec.Time != 1665000000123 {
+		t.Errorf("json _t got %#v", jrec.Time)
+	}
+	eq(t, "0xA053", jrec.PID)
+}
+
+func TestDecodeRecordBadInt(t *testing.T) {
+	rec, err := DecodeRecord(map[string]string{"V": "12.5", "CS": "5"})
+	if err == nil {
+		t.Error("expected error for bad int")
+	}
+	if rec.V != nil {
+		t.Errorf("V got %#v", rec.V)
+	}
+	eq(t, "12.5", rec.Unknown["V"])
+	eq(t, "5", rec.CS)
+}
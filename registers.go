@@ -8,6 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"strconv"
 	"strings"
 )
@@ -18,6 +19,15 @@ var mppt_regs_csv string
 //go:embed phoenix_inverter_regs.csv
 var phoenix_inverter_regs_csv string
 
+//go:embed bmv_regs.csv
+var bmv_regs_csv string
+
+//go:embed charger_regs.csv
+var charger_regs_csv string
+
+//go:embed dcdc_regs.csv
+var dcdc_regs_csv string
+
 type VERegister struct {
 	Address     uint16   `json:"a"`
 	Name        string   `json:"n"`
@@ -29,7 +39,7 @@ type VERegister struct {
 
 type RegType int
 
-// rt = list(zip('u8 u16 u32 s8 s16 s32 unk'.split(' '), range(1,8)))
+// rt = list(zip('u8 u16 u32 s8 s16 s32 unk u24 str'.split(' '), range(1,10)))
 // print("const (\n" + "\n".join([f"\tRegType_{rn} RegType = {ri}" for rn,ri in rt]) + "\n)")
 // print("var RegTypeNameToRegType map[string]RegType = map[string]RegType{\n" + "\n".join([f"\t\"{rn}\":RegType_{rn}," for rn,ri in rt]) + "\n}")
 
@@ -41,18 +51,31 @@ const (
 	RegType_s16 RegType = 5
 	RegType_s32 RegType = 6
 	RegType_unk RegType = 7
+	RegType_u24 RegType = 8
+
+	// RegType_str is text, all of the data. Fixed length strings are padded with NUL, which is trimmed.
+	RegType_str RegType = 9
+
+	// RegType_u16_u32 is "u16|u32", u16 or u32 depending on the device, decoded by data length as uint32
+	RegType_u16_u32 RegType = 10
 )
 
 var RegTypeNameToRegType map[string]RegType = map[string]RegType{
-	"u8":  RegType_u8,
-	"u16": RegType_u16,
-	"u32": RegType_u32,
-	"s8":  RegType_s8,
-	"s16": RegType_s16,
-	"s32": RegType_s32,
-	"unk": RegType_unk,
+	"u8":      RegType_u8,
+	"u16":     RegType_u16,
+	"u32":     RegType_u32,
+	"s8":      RegType_s8,
+	"s16":     RegType_s16,
+	"s32":     RegType_s32,
+	"unk":     RegType_unk,
+	"u24":     RegType_u24,
+	"str":     RegType_str,
+	"u16|u32": RegType_u16_u32,
 }
 
+// summary column values, see StreamingSummary
+var summaryModeNames = map[string]bool{"mean": true, "last": true, "mode": true, "min": true, "max": true}
+
 var ErrHexDataShort = errors.New("VE HEX data too short for desired register")
 var ErrHexTypeUnknown = errors.New("VE HEX data not a known register value type")
 
@@ -61,6 +84,10 @@ var ErrHexTypeUnknown = errors.New("VE HEX data not a known register value type"
 func parseByRegType(hbytes []byte, rt RegType) (value any, err error) {
 	switch rt {
 	case RegType_u8:
+		if len(hbytes) < 1 {
+			err = ErrHexDataShort
+			return
+		}
 		value = hbytes[0]
 	case RegType_u16:
 		if len(hbytes) < 2 {
@@ -74,7 +101,28 @@ func parseByRegType(hbytes []byte, rt RegType) (value any, err error) {
 			return
 		}
 		value = binary.LittleEndian.Uint32(hbytes[:4])
+	case RegType_u24:
+		if len(hbytes) < 3 {
+			err = ErrHexDataShort
+			return
+		}
+		value = uint32(hbytes[0]) | uint32(hbytes[1])<<8 | uint32(hbytes[2])<<16
+	case RegType_u16_u32:
+		if len(hbytes) >= 4 {
+			value = binary.LittleEndian.Uint32(hbytes[:4])
+		} else if len(hbytes) >= 2 {
+			value = uint32(binary.LittleEndian.Uint16(hbytes[:2]))
+		} else {
+			err = ErrHexDataShort
+			return
+		}
+	case RegType_str:
+		value = strings.TrimRight(string(hbytes), "\x00")
 	case RegType_s8:
+		if len(hbytes) < 1 {
+			err = ErrHexDataShort
+			return
+		}
 		value = int8(hbytes[0])
 	case RegType_s16:
 		if len(hbytes) < 2 {
@@ -96,6 +144,109 @@ func parseByRegType(hbytes []byte, rt RegType) (value any, err error) {
 	return
 }
 
+var ErrHexValueRange = errors.New("VE HEX value out of range for register")
+
+// RawValue is a register value in raw register units, e.g. RawValue(1440) for 14.40 V in a 0.01 scale register.
+// EncodeRegisterValue and SetRegister write it as is, without Scale.
+type RawValue int64
+
+// EncodeRegisterValue encodes value as little-endian bytes for a HEX Set of reg.
+//
+// Numbers are in the register's display units and are divided by Scale and rounded, e.g. 14.4 or 14 (V) for a 0.01 scale u16 becomes 1440 or 1400.
+// A RawValue is raw register units, as returned by GetRegister.
+// String registers take a string or []byte. A u16|u32 register is written as u32.
+func EncodeRegisterValue(reg VERegister, value any) ([]byte, error) {
+	if reg.Size == RegType_str {
+		switch x := value.(type) {
+		case string:
+			return []byte(x), nil
+		case []byte:
+			return append([]byte(nil), x...), nil
+		}
+		return nil, fmt.Errorf("VE HEX cannot encode %T for string register %s", value, reg.Name)
+	}
+	var f float64
+	switch x := value.(type) {
+	case RawValue:
+		return encodeRegisterRaw(reg, int64(x), value)
+	case float64:
+		f = x
+	case float32:
+		f = float64(x)
+	case int:
+		f = float64(x)
+	case int8:
+		f = float64(x)
+	case int16:
+		f = float64(x)
+	case int32:
+		f = float64(x)
+	case int64:
+		f = float64(x)
+	case uint:
+		f = float64(x)
+	case uint8:
+		f = float64(x)
+	case uint16:
+		f = float64(x)
+	case uint32:
+		f = float64(x)
+	case uint64:
+		f = float64(x)
+	default:
+		return nil, fmt.Errorf("VE HEX cannot encode %T for register %s", value, reg.Name)
+	}
+	if reg.Scale != nil && *reg.Scale != 0 {
+		f = f / *reg.Scale
+	}
+	f = math.Round(f)
+	if math.IsNaN(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return nil, fmt.Errorf("%w: %s %v", ErrHexValueRange, reg.Name, value)
+	}
+	return encodeRegisterRaw(reg, int64(f), value)
+}
+
+// encodeRegisterRaw encodes iv in raw register units, value is for errors
+func encodeRegisterRaw(reg VERegister, iv int64, value any) ([]byte, error) {
+	var lo, hi int64
+	var out []byte
+	switch reg.Size {
+	case RegType_u8:
+		lo, hi = 0, math.MaxUint8
+		out = []byte{byte(iv)}
+	case RegType_u16:
+		lo, hi = 0, math.MaxUint16
+		out = make([]byte, 2)
+		binary.LittleEndian.PutUint16(out, uint16(iv))
+	case RegType_u32, RegType_u16_u32:
+		lo, hi = 0, math.MaxUint32
+		out = make([]byte, 4)
+		binary.LittleEndian.PutUint32(out, uint32(iv))
+	case RegType_u24:
+		lo, hi = 0, 1<<24-1
+		out = []byte{byte(iv), byte(iv >> 8), byte(iv >> 16)}
+	case RegType_s8:
+		lo, hi = math.MinInt8, math.MaxInt8
+		out = []byte{byte(iv)}
+	case RegType_s16:
+		lo, hi = math.MinInt16, math.MaxInt16
+		out = make([]byte, 2)
+		binary.LittleEndian.PutUint16(out, uint16(iv))
+	case RegType_s32:
+		lo, hi = math.MinInt32, math.MaxInt32
+		out = make([]byte, 4)
+		binary.LittleEndian.PutUint32(out, uint32(iv))
+	default:
+		return nil, ErrHexTypeUnknown
+	}
+	if iv < lo || iv > hi {
+		return nil, fmt.Errorf("%w: %s %v", ErrHexValueRange, reg.Name, value)
+	}
+	return out, nil
+}
+
+// readRegsCsv parses a register table, "address,name,multiplier,type,unit,summary" per line.
+// Unknown types, duplicate addresses and bad summary modes are errors. An empty summary mode leaves the register out of summaries.
 func readRegsCsv(x string) ([]VERegister, error) {
 	out := make([]VERegister, 0, 50) // TODO: count the lines before allocating?
 	fin := strings.NewReader(x)
@@ -103,6 +254,8 @@ func readRegsCsv(x string) ([]VERegister, error) {
 	reader.Comment = '#'
 	reader.TrimLeadingSpace = true
 	reader.ReuseRecord = true
+	reader.FieldsPerRecord = 6
+	lines := make(map[uint16]int)
 
 	for true {
 		parts, err := reader.Read()
@@ -113,30 +266,38 @@ func readRegsCsv(x string) ([]VERegister, error) {
 			err = fmt.Errorf("regs csv parse err, %w", err)
 			return nil, err
 		}
+		line, _ := reader.FieldPos(0)
 		addrStr := parts[0]
 		if strings.HasPrefix(addrStr, "0x") {
 			addrStr = addrStr[2:]
 		}
 		addr, err := strconv.ParseUint(addrStr, 16, 16)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("regs csv line %d: bad address %#v, %w", line, parts[0], err)
+		}
+		if prev, dup := lines[uint16(addr)]; dup {
+			return nil, fmt.Errorf("regs csv line %d: address 0x%04x already on line %d", line, addr, prev)
 		}
+		lines[uint16(addr)] = line
 		name := parts[1]
 		var scale *float64 = nil
 		if parts[2] != "" {
 			scalev, err := strconv.ParseFloat(parts[2], 64)
 			if err != nil {
-				return nil, err
+				return nil, fmt.Errorf("regs csv line %d: bad multiplier %#v, %w", line, parts[2], err)
 			}
 			scale = new(float64)
 			*scale = scalev
 		}
 		regsize, ok := RegTypeNameToRegType[parts[3]]
 		if !ok {
-			regsize = RegType_unk
+			return nil, fmt.Errorf("regs csv line %d: unknown type %#v", line, parts[3])
 		}
 		unit := parts[4]
 		summaryMode := parts[5]
+		if summaryMode != "" && !summaryModeNames[summaryMode] {
+			return nil, fmt.Errorf("regs csv line %d: bad summary mode %#v", line, summaryMode)
+		}
 		out = append(
 			out,
 			VERegister{
@@ -168,6 +329,33 @@ func VE_PhoenixInverter_Registers() []VERegister {
 	return out
 }
 
+// VE_BMV_Registers are the registers of BMV and SmartShunt battery monitors
+func VE_BMV_Registers() []VERegister {
+	out, err := readRegsCsv(bmv_regs_csv)
+	if err != nil {
+		panic(err)
+	}
+	return out
+}
+
+// VE_Charger_Registers are the registers of Blue Smart and Skylla AC chargers
+func VE_Charger_Registers() []VERegister {
+	out, err := readRegsCsv(charger_regs_csv)
+	if err != nil {
+		panic(err)
+	}
+	return out
+}
+
+// VE_DCDC_Registers are the registers of Orion DC-DC converters
+func VE_DCDC_Registers() []VERegister {
+	out, err := readRegsCsv(dcdc_regs_csv)
+	if err != nil {
+		panic(err)
+	}
+	return out
+}
+
 var cachedMPPTRegisters []VERegister
 
 // local versioun that does caching, and we're sure we won't corrupt this copy
@@ -188,13 +376,47 @@ func invRegs() []VERegister {
 	return cachedPhoenixInverterRegisters
 }
 
+var cachedBMVRegisters []VERegister
+
+// local versioun that does caching, and we're sure we won't corrupt this copy
+func bmvRegs() []VERegister {
+	if cachedBMVRegisters == nil {
+		cachedBMVRegisters = VE_BMV_Registers()
+	}
+	return cachedBMVRegisters
+}
+
+var cachedChargerRegisters []VERegister
+
+// local versioun that does caching, and we're sure we won't corrupt this copy
+func chargerRegs() []VERegister {
+	if cachedChargerRegisters == nil {
+		cachedChargerRegisters = VE_Charger_Registers()
+	}
+	return cachedChargerRegisters
+}
+
+var cachedDCDCRegisters []VERegister
+
+// local versioun that does caching, and we're sure we won't corrupt this copy
+func dcdcRegs() []VERegister {
+	if cachedDCDCRegisters == nil {
+		cachedDCDCRegisters = VE_DCDC_Registers()
+	}
+	return cachedDCDCRegisters
+}
+
 var cachedAllRegs [][]VERegister
 
+// register tables searched in order, the first with an address wins
 func allRegs() [][]VERegister {
 	if cachedAllRegs == nil {
-		cachedAllRegs = make([][]VERegister, 2)
+		cachedAllRegs = make([][]VERegister, 5)
 		cachedAllRegs[0] = mpptRegs()
 		cachedAllRegs[1] = invRegs()
+		cachedAllRegs[2] = bmvRegs()
+		cachedAllRegs[3] = chargerRegs()
+		cachedAllRegs[4] = dcdcRegs()
 	}
 	return cachedAllRegs
 }
@@ -206,11 +428,138 @@ type VERegValue struct {
 	Value    any
 }
 
-// Parse register value from a VE.HEX message.
-// Not fully general, this filters on 0x7 and 0xA messages which are:
-//   * 0x7 response to register get
-//   * 0xA asynchronously volunteered register update
-func ParseHexRecord(x string) (value *VERegValue, err error) {
+// Float is the value scaled into Register.Unit, e.g. 13.82 (V) for 1382 in a 0.01 scale register.
+// String values are ErrNotANumber.
+func (rv *VERegValue) Float() (float64, error) {
+	var f float64
+	switch x := rv.Value.(type) {
+	case uint8:
+		f = float64(x)
+	case uint16:
+		f = float64(x)
+	case uint32:
+		f = float64(x)
+	case int8:
+		f = float64(x)
+	case int16:
+		f = float64(x)
+	case int32:
+		f = float64(x)
+	case int64:
+		f = float64(x)
+	case float64:
+		f = x
+	default:
+		return 0, ErrNotANumber
+	}
+	if rv.Register.Scale != nil {
+		// divide by 100 rather than multiply by 0.01, 1382 becomes 13.82 not 13.820000000000002
+		inv := 1 / *rv.Register.Scale
+		if inv == math.Trunc(inv) {
+			f = f / inv
+		} else {
+			f = f * *rv.Register.Scale
+		}
+	}
+	return f, nil
+}
+
+// In converts the value to unit, e.g. In("°C") of a battery temperature in K
+func (rv *VERegValue) In(unit string) (float64, error) {
+	f, err := rv.Float()
+	if err != nil {
+		return 0, err
+	}
+	return ConvertUnit(f, rv.Register.Unit, unit)
+}
+
+// Engineering is the value in the unit it is usually shown in, which is the register's unit except K becomes °C
+func (rv *VERegValue) Engineering() (float64, string, error) {
+	unit := rv.Register.Unit
+	if eu, ok := engineeringUnits[unit]; ok {
+		f, err := rv.In(eu)
+		return f, eu, err
+	}
+	f, err := rv.Float()
+	return f, unit, err
+}
+
+// String formats the value with its unit at the precision of its scale, e.g. "13.82 V"
+func (rv *VERegValue) String() string {
+	switch x := rv.Value.(type) {
+	case string:
+		return x
+	case []byte:
+		return ehex.EncodeToString(x)
+	}
+	f, err := rv.Float()
+	if err != nil {
+		return fmt.Sprint(rv.Value)
+	}
+	decimals := 0
+	if rv.Register.Scale != nil {
+		ss := strconv.FormatFloat(*rv.Register.Scale, 'f', -1, 64)
+		if dot := strings.IndexByte(ss, '.'); dot >= 0 {
+			decimals = len(ss) - dot - 1
+		}
+	}
+	out := strconv.FormatFloat(f, 'f', decimals, 64)
+	if rv.Register.Unit != "" {
+		out += " " + rv.Register.Unit
+	}
+	return out
+}
+
+// HexResponse is the first byte of a HEX message from a device
+type HexResponse byte
+
+const (
+	HexDone    HexResponse = 0x1 // reply to AppVersion, ProductId
+	HexUnknown HexResponse = 0x3 // unknown command
+	HexError   HexResponse = 0x4 // framing error
+	HexPing    HexResponse = 0x5 // reply to Ping
+	HexGet     HexResponse = 0x7
+	HexSet     HexResponse = 0x8
+	HexAsync   HexResponse = 0xA
+)
+
+var hexResponseNames = map[HexResponse]string{
+	HexDone:    "done",
+	HexUnknown: "unknown command",
+	HexError:   "framing error",
+	HexPing:    "ping",
+	HexGet:     "get",
+	HexSet:     "set",
+	HexAsync:   "async",
+}
+
+func (hr HexResponse) String() string {
+	name, ok := hexResponseNames[hr]
+	if ok {
+		return name
+	}
+	return fmt.Sprintf("HexResponse(0x%x)", byte(hr))
+}
+
+// IsRegister is true for Get, Set and Async messages which have Register and Flags
+func (hr HexResponse) IsRegister() bool {
+	return hr == HexGet || hr == HexSet || hr == HexAsync
+}
+
+// HexMessage is one decoded HEX protocol message from a device
+type HexMessage struct {
+	Response HexResponse
+
+	// Register and Flags are only set if Response.IsRegister()
+	Register uint16
+	Flags    byte
+
+	// Data after the response code (or register and flags), without the checksum
+	Data []byte
+}
+
+// ParseHexMessage decodes any HEX message, as found in data["_x"].
+func ParseHexMessage(x string) (msg *HexMessage, err error) {
 	blen := len(x) / 2
 	hbytes := make([]byte, blen)
 	count, err := ehex.Decode(hbytes, []byte(x))
@@ -226,36 +575,83 @@ func ParseHexRecord(x string) (value *VERegValue, err error) {
 		err = fmt.Errorf("VE HEX bad checksum, 0x%02x != 0x55", hexSum&0x0ff)
 		return
 	}
-	if hbytes[0] == 0x0a || hbytes[0] == 0x07 {
-		// okay
-		// 0x0a asynchronously volunteered register data update
-		// 0x07 respeonse to register get
+	return parseHexBytes(hbytes[:count])
+}
+
+// parseHexBytes splits a checksummed message, [response, ..., checksum]
+func parseHexBytes(hbytes []byte) (*HexMessage, error) {
+	if len(hbytes) < 2 {
+		return nil, ErrHexDataShort
+	}
+	msg := &HexMessage{Response: HexResponse(hbytes[0])}
+	if msg.Response.IsRegister() {
+		if len(hbytes) < 5 {
+			return nil, ErrHexDataShort
+		}
+		msg.Register = binary.LittleEndian.Uint16(hbytes[1:3])
+		msg.Flags = hbytes[3]
+		msg.Data = hbytes[4 : len(hbytes)-1]
 	} else {
-		err = ErrNotData
-		return
+		msg.Data = hbytes[1 : len(hbytes)-1]
+	}
+	return msg, nil
+}
+
+// Err returns ErrHexUnknownCommand or ErrHexFraming for those responses, a *HexFlagError for a register message with flags set, or nil
+func (m *HexMessage) Err() error {
+	switch m.Response {
+	case HexUnknown:
+		return ErrHexUnknownCommand
+	case HexError:
+		return ErrHexFraming
+	}
+	if m.Flags != 0 {
+		return &HexFlagError{Register: m.Register, Flags: m.Flags}
 	}
-	if hbytes[3] != 0 {
-		// TODO: somewhere I have docs on at least what bits 0x07 mean, make nice messages
-		err = fmt.Errorf("VE HEX message has error flag 0x%02x", hbytes[3])
+	return nil
+}
+
+// Value decodes Data of a register message using the known register tables, see Registry for devices with a known PID
+func (m *HexMessage) Value() (value *VERegValue, err error) {
+	return DefaultRegistry.Value(0, m)
+}
+
+// Parse register value from a VE.HEX message.
+// Not fully general, this filters on 0x7 and 0xA messages which are:
+//   * 0x7 response to register get
+//   * 0xA asynchronously volunteered register update
+//
+// Unknown command and framing error responses return ErrHexUnknownCommand and ErrHexFraming, other messages ErrNotData.
+// See ParseHexMessage for all message types.
+func ParseHexRecord(x string) (value *VERegValue, err error) {
+	return ParseHexRecordFor(x, 0)
+}
+
+// ParseHexRecordFor is ParseHexRecord for a message from a device with PID pid, resolving registers with DefaultRegistry
+func ParseHexRecordFor(x string, pid ProductID) (value *VERegValue, err error) {
+	msg, err := ParseHexMessage(x)
+	if err != nil {
 		return
 	}
-	register := binary.LittleEndian.Uint16(hbytes[1:3])
-	for _, regs := range allRegs() {
-		for _, reg := range regs {
-			if reg.Address == register {
-				var rv any
-				rv, err = parseByRegType(hbytes[4:], reg.Size)
-				if err != nil {
-					return
-				}
-				value = &VERegValue{
-					Register: reg,
-					Value:    rv,
-				}
-				return
-			}
-		}
+	switch msg.Response {
+	case HexAsync, HexGet:
+		// okay
+		// 0x0a asynchronously volunteered register data update
+		// 0x07 respeonse to register get
+		return DefaultRegistry.Value(pid, msg)
+	case HexUnknown, HexError:
+		err = msg.Err()
+	default:
+		err = ErrNotData
 	}
-	err = fmt.Errorf("VE HEX unknown register 0x%04x", register)
 	return
 }
+
+// parseRegisterMessage parses a checksummed 0x7, 0x8 or 0xA message, [response, addr lo, addr hi, flags, value..., checksum]
+func parseRegisterMessage(hbytes []byte, registry *Registry, pid ProductID) (*VERegValue, error) {
+	msg, err := parseHexBytes(hbytes)
+	if err != nil {
+		return nil, err
+	}
+	return registry.Value(pid, msg)
+}
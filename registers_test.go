@@ -1,7 +1,10 @@
 package vedirect
 
 import (
+	ehex "encoding/hex"
 	"encoding/json"
+	"errors"
+	"math"
 	"strings"
 	"testing"
 )
@@ -20,3 +23,255 @@ func TestAllRegs(t *testing.T) {
 	}
 	t.Log(ns.String())
 }
+
+type encodeCase struct {
+	scale float64
+	size  RegType
+	value any
+	hex   string
+}
+
+var encodeCases = []encodeCase{
+	{0.01, RegType_u16, 14.4, "a005"},
+	{0.01, RegType_u16, float32(14.4), "a005"},
+	{0.01, RegType_u16, RawValue(1440), "a005"},
+	{0.01, RegType_u16, 14, "7805"},
+	{0.01, RegType_u16, 14.0, "7805"},
+	{0.01, RegType_s16, -12.5, "1efb"},
+	{0, RegType_u8, uint8(3), "03"},
+	{0, RegType_s8, -1, "ff"},
+	{0.001, RegType_u32, 70.0, "70110100"},
+	{1, RegType_s32, int64(-2), "feffffff"},
+	{0.01, RegType_u24, 100000.0, "809698"},
+	{0, RegType_u16_u32, 7, "07000000"},
+	{0, RegType_str, "HQ1234", "485131323334"},
+}
+
+func TestEncodeRegisterValue(t *testing.T) {
+	for i, tc := range encodeCases {
+		reg := VERegister{Name: "test", Size: tc.size}
+		if tc.scale != 0 {
+			reg.Scale = &tc.scale
+		}
+		data, err := EncodeRegisterValue(reg, tc.value)
+		if err != nil {
+			t.Errorf("[%d] %#v: %v", i, tc.value, err)
+			continue
+		}
+		eq(t, tc.hex, ehex.EncodeToString(data))
+		rv, _ := parseByRegType(data, tc.size)
+		var back []byte
+		if f, err := (&VERegValue{Register: reg, Value: rv}).Float(); err == nil {
+			back, _ = EncodeRegisterValue(reg, f)
+		} else {
+			back, _ = EncodeRegisterValue(reg, rv)
+		}
+		eq(t, tc.hex, ehex.EncodeToString(back))
+	}
+	// whole numbers are scaled as floats are, 14 V is not 0.14 V
+	volts := 0.01
+	absorption := VERegister{Name: "absorption voltage", Scale: &volts, Size: RegType_u16}
+	a, _ := EncodeRegisterValue(absorption, int(14))
+	b, _ := EncodeRegisterValue(absorption, 14.0)
+	eq(t, "7805", ehex.EncodeToString(a))
+	eq(t, ehex.EncodeToString(a), ehex.EncodeToString(b))
+	_, err := EncodeRegisterValue(absorption, 1440)
+	eq(t, true, errors.Is(err, ErrHexValueRange))
+
+	_, err = EncodeRegisterValue(VERegister{Size: RegType_u8}, 256)
+	eq(t, true, errors.Is(err, ErrHexValueRange))
+	_, err = EncodeRegisterValue(VERegister{Size: RegType_u16}, -1)
+	eq(t, true, errors.Is(err, ErrHexValueRange))
+	_, err = EncodeRegisterValue(VERegister{Size: RegType_unk}, 1)
+	eq(t, ErrHexTypeUnknown, err)
+	_, err = EncodeRegisterValue(VERegister{Size: RegType_u8}, "1")
+	eq(t, true, err != nil)
+	_, err = EncodeRegisterValue(VERegister{Size: RegType_u24}, 1<<24)
+	eq(t, true, errors.Is(err, ErrHexValueRange))
+	_, err = EncodeRegisterValue(VERegister{Size: RegType_str}, 1)
+	eq(t, true, err != nil)
+}
+
+func TestParseByRegType(t *testing.T) {
+	v, err := parseByRegType([]byte{0x01, 0x02, 0x03, 0xff}, RegType_u24)
+	eq(t, nil, err)
+	eq(t, uint32(0x030201), v)
+	_, err = parseByRegType([]byte{0x01, 0x02}, RegType_u24)
+	eq(t, ErrHexDataShort, err)
+	v, _ = parseByRegType([]byte{0x01, 0x02}, RegType_u16_u32)
+	eq(t, uint32(0x0201), v)
+	v, _ = parseByRegType([]byte{0x01, 0x02, 0x03, 0x04}, RegType_u16_u32)
+	eq(t, uint32(0x04030201), v)
+	_, err = parseByRegType([]byte{0x01}, RegType_u16_u32)
+	eq(t, ErrHexDataShort, err)
+	v, _ = parseByRegType([]byte("SmartShunt\x00\x00"), RegType_str)
+	eq(t, "SmartShunt", v)
+	v, _ = parseByRegType(nil, RegType_str)
+	eq(t, "", v)
+}
+
+func TestReadRegsCsv(t *testing.T) {
+	regs, err := readRegsCsv("# comment\n0x0100,product id,,u32,,last\n0x010a,serial number,,str,,mode\n0xed8d,main voltage,0.01,s16,V,\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq(t, 3, len(regs))
+	eq(t, RegType_str, regs[1].Size)
+	eq(t, 0.01, *regs[2].Scale)
+	eq(t, "", regs[2].SummaryMode)
+
+	for _, tc := range []struct {
+		csv string
+		err string
+	}{
+		{"0x0100,a,,u32,,last\n0x0101,b,,u17,,last\n", "line 2: unknown type"},
+		{"0x0100,a,,u32,,last\n0x0101,b,,,,last\n", "line 2: unknown type"},
+		{"0x0100,a,,u32,,last\n\n0x0100,b,,u32,,last\n", "line 3: address 0x0100 already on line 1"},
+		{"0x0100,a,,u32,,median\n", "line 1: bad summary mode"},
+		{"0x0100,a,x,u32,,last\n", "line 1: bad multiplier"},
+		{"0xg100,a,,u32,,last\n", "line 1: bad address"},
+	} {
+		_, err := readRegsCsv(tc.csv)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%#v: wanted %#v, got %v", tc.csv, tc.err, err)
+		}
+	}
+}
+
+// "_x" form of a message from a device
+func testHex(resp HexResponse, msg ...byte) string {
+	line := formatHexCommand(Command(resp), msg)
+	return "0" + string(line[1:len(line)-1])
+}
+
+func TestParseHexMessage(t *testing.T) {
+	msg, err := ParseHexMessage(testHex(HexPing, 0x16, 0x41))
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq(t, HexPing, msg.Response)
+	eq(t, "1641", ehex.EncodeToString(msg.Data))
+	eq(t, nil, msg.Err())
+	_, err = msg.Value()
+	eq(t, ErrNotData, err)
+
+	msg, _ = ParseHexMessage(testHex(HexAsync, 0xbb, 0xed, 0, 0x10, 0x27))
+	eq(t, uint16(0xedbb), msg.Register)
+	rv, err := msg.Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq(t, uint16(10000), rv.Value)
+
+	msg, _ = ParseHexMessage(testHex(HexSet, 0xf0, 0xed, 0x06))
+	eq(t, true, errors.Is(msg.Err(), ErrHexNotSupported))
+	eq(t, true, errors.Is(msg.Err(), ErrHexParameter))
+	eq(t, false, errors.Is(msg.Err(), ErrHexUnknownRegister))
+
+	_, err = ParseHexMessage("0352")
+	eq(t, nil, err)
+	_, err = ParseHexMessage("0353")
+	eq(t, true, err != nil)
+	eq(t, "unknown command", HexUnknown.String())
+}
+
+func TestBMVRegisters(t *testing.T) {
+	// state of charge 87.65%
+	rv, err := ParseHexRecord(testHex(HexAsync, 0xff, 0x0f, 0, 0x3d, 0x22))
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq(t, "state of charge", rv.Register.Name)
+	eq(t, uint16(8765), rv.Value)
+	// consumed Ah -12.3
+	rv, err = ParseHexRecord(testHex(HexGet, 0xff, 0xee, 0, 0x85, 0xff, 0xff, 0xff))
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq(t, "consumed Ah", rv.Register.Name)
+	eq(t, int32(-123), rv.Value)
+	// mid-point voltage 12.80 V, deviation -1.5%
+	rv, err = ParseHexRecordFor(testHex(HexAsync, 0x82, 0x03, 0, 0x00, 0x05), 0xA381)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq(t, "mid-point voltage", rv.Register.Name)
+	eq(t, "12.80 V", rv.String())
+	rv, err = ParseHexRecordFor(testHex(HexAsync, 0x83, 0x03, 0, 0xf1, 0xff), 0xA381)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq(t, "mid-point voltage deviation", rv.Register.Name)
+	eq(t, int16(-15), rv.Value)
+
+	they := []map[string]interface{}{
+		{"_x": testHex(HexAsync, 0xff, 0x0f, 0, 0x10, 0x27)},
+		{"_x": testHex(HexAsync, 0xff, 0x0f, 0, 0x30, 0x25)},
+		{"_x": testHex(HexAsync, 0xff, 0xee, 0, 0x85, 0xff, 0xff, 0xff)},
+	}
+	sum := summarize(they, false)
+	eq(t, float64(9760), sum["state of charge"])
+	eq(t, int32(-123), sum["consumed Ah"])
+	sum = summarize(they, true)
+	eq(t, 97.6, sum["state of charge"])
+	eq(t, -12.3, sum["consumed Ah"])
+}
+
+func TestVERegValueUnits(t *testing.T) {
+	volts := 0.01
+	rv := VERegValue{Register: VERegister{Name: "battery voltage", Scale: &volts, Size: RegType_u16, Unit: "V"}, Value: uint16(1382)}
+	f, err := rv.Float()
+	eq(t, nil, err)
+	eq(t, 13.82, f)
+	eq(t, "13.82 V", rv.String())
+	mv, _ := rv.In("mV")
+	eq(t, 13820.0, mv)
+	_, err = rv.In("A")
+	eq(t, true, errors.Is(err, ErrUnitConversion))
+
+	kelvin := 0.01
+	rv = VERegValue{Register: VERegister{Name: "battery temperature", Scale: &kelvin, Size: RegType_u16, Unit: "K"}, Value: uint16(29815)}
+	eq(t, "298.15 K", rv.String())
+	f, unit, err := rv.Engineering()
+	eq(t, nil, err)
+	eq(t, "°C", unit)
+	if math.Abs(f-25) > 1e-9 {
+		t.Errorf("wanted 25 °C, got %f", f)
+	}
+
+	rv = VERegValue{Register: VERegister{Name: "model name", Size: RegType_str}, Value: "SmartShunt"}
+	eq(t, "SmartShunt", rv.String())
+	_, err = rv.Float()
+	eq(t, ErrNotANumber, err)
+	rv = VERegValue{Register: VERegister{Name: "mode", Size: RegType_u8}, Value: uint8(4)}
+	eq(t, "4", rv.String())
+	f, unit, _ = rv.Engineering()
+	eq(t, 4.0, f)
+	eq(t, "", unit)
+}
+
+func TestDCDCRegisters(t *testing.T) {
+	// only the DC-DC table has engine shutdown detection
+	rv, err := ParseHexRecord(testHex(HexGet, 0x39, 0xee, 0, 0x2c, 0x05))
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq(t, "engine start voltage", rv.Register.Name)
+	eq(t, uint16(1324), rv.Value)
+}
+
+func TestParseHexRecordErrors(t *testing.T) {
+	_, err := ParseHexRecord(testHex(HexUnknown))
+	eq(t, ErrHexUnknownCommand, err)
+	_, err = ParseHexRecord(testHex(HexError))
+	eq(t, ErrHexFraming, err)
+	_, err = ParseHexRecord(testHex(HexPing, 0x16, 0x41))
+	eq(t, ErrNotData, err)
+	_, err = ParseHexRecord(testHex(HexGet, 0xf0, 0xed, 0x01))
+	eq(t, true, errors.Is(err, ErrHexUnknownRegister))
+	rv, err := ParseHexRecord(testHex(HexGet, 0xf0, 0xed, 0, 0x96, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq(t, uint16(150), rv.Value)
+}
@@ -0,0 +1,119 @@
+package vedirect
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Registry finds register definitions for a device.
+//
+// A register address can mean different things on different products, e.g. 0x2211 is "adjustable voltage minimum" on an MPPT and "voltage range min" on a Phoenix inverter.
+// Lookup searches the table for the device's PID, then its product family.
+// A device of unknown family, or not known yet (PID 0), searches every table in the fallback order.
+type Registry struct {
+	l        sync.RWMutex
+	products map[ProductID][]VERegister
+	families map[ProductFamily][]VERegister
+	fallback [][]VERegister
+}
+
+// DefaultRegistry has the built in register tables, used by ParseHexRecord and by Vedirect unless Options.Registry is set
+var DefaultRegistry = NewRegistry()
+
+// NewRegistry returns a Registry with the built in register tables for each product family
+func NewRegistry() *Registry {
+	r := &Registry{
+		products: make(map[ProductID][]VERegister),
+		families: make(map[ProductFamily][]VERegister),
+	}
+	r.families[FamilyMPPT] = mpptRegs()
+	r.families[FamilyInverter] = invRegs()
+	r.families[FamilyBMV] = bmvRegs()
+	r.families[FamilyCharger] = chargerRegs()
+	r.families[FamilyDCDC] = dcdcRegs()
+	r.fallback = allRegs()
+	return r
+}
+
+// AddFamily sets the register table of a product family
+func (r *Registry) AddFamily(family ProductFamily, regs []VERegister) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	r.families[family] = regs
+}
+
+// AddProduct sets the register table of one product, searched before its family's
+func (r *Registry) AddProduct(pid ProductID, regs []VERegister) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	r.products[pid] = regs
+}
+
+// Lookup the register at addr on a device with PID pid, 0 if not known
+func (r *Registry) Lookup(pid ProductID, addr uint16) (reg VERegister, ok bool) {
+	r.l.RLock()
+	defer r.l.RUnlock()
+	family := FamilyUnknown
+	if pid != 0 {
+		if reg, ok = findRegister(r.products[pid], addr); ok {
+			return
+		}
+		family = ProductFamilyForPID(pid)
+		if reg, ok = findRegister(r.families[family], addr); ok {
+			return
+		}
+	}
+	if family != FamilyUnknown {
+		// another product's register of the same address would be decoded wrong
+		return
+	}
+	for _, regs := range r.fallback {
+		if reg, ok = findRegister(regs, addr); ok {
+			return
+		}
+	}
+	return
+}
+
+func findRegister(regs []VERegister, addr uint16) (VERegister, bool) {
+	for _, reg := range regs {
+		if reg.Address == addr {
+			return reg, true
+		}
+	}
+	return VERegister{}, false
+}
+
+// ErrUnknownRegisterDef is returned with a VERegValue of the raw Data ([]byte) for a register that is not in the device's register tables
+var ErrUnknownRegisterDef = errors.New("VE HEX register not in register tables")
+
+// Value decodes Data of a register message from a device with PID pid, 0 if not known
+func (r *Registry) Value(pid ProductID, m *HexMessage) (value *VERegValue, err error) {
+	if !m.Response.IsRegister() {
+		err = ErrNotData
+		return
+	}
+	if err = m.Err(); err != nil {
+		return
+	}
+	reg, ok := r.Lookup(pid, m.Register)
+	if !ok {
+		// the raw data is still useful to the caller
+		value = &VERegValue{
+			Register: VERegister{Address: m.Register, Name: fmt.Sprintf("0x%04x", m.Register), Size: RegType_unk},
+			Value:    append([]byte(nil), m.Data...),
+		}
+		err = fmt.Errorf("%w: 0x%04x", ErrUnknownRegisterDef, m.Register)
+		return
+	}
+	rv, err := parseByRegType(m.Data, reg.Size)
+	if err != nil {
+		return
+	}
+	value = &VERegValue{
+		Register: reg,
+		Value:    rv,
+	}
+	return
+}
@@ -0,0 +1,81 @@
+package vedirect
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	reg, ok := r.Lookup(0, 0x2211)
+	eq(t, true, ok)
+	eq(t, "adjustable voltage minimum", reg.Name)
+	// Phoenix inverter
+	reg, _ = r.Lookup(0xA211, 0x2211)
+	eq(t, "voltage range min", reg.Name)
+	// SmartShunt, found in the BMV table before the inverter's "DC channel1 voltage"
+	reg, _ = r.Lookup(0xA389, 0xed8d)
+	eq(t, "main voltage", reg.Name)
+	// not in the MPPT table, a known product doesn't fall back
+	_, ok = r.Lookup(0xA053, 0x0100)
+	eq(t, false, ok)
+	_, ok = r.Lookup(0xA053, 0x1234)
+	eq(t, false, ok)
+	// MPPT absorption voltage isn't a BMV register
+	_, ok = r.Lookup(0xA389, 0xedf7)
+	eq(t, false, ok)
+	rv, err := ParseHexRecordFor(testHex(HexGet, 0xf7, 0xed, 0, 0xa0, 0x05), 0xA389)
+	eq(t, true, errors.Is(err, ErrUnknownRegisterDef))
+	eq(t, "a005", rv.String())
+	// unknown family falls back
+	reg, ok = r.Lookup(0xFFFE, 0xedf7)
+	eq(t, true, ok)
+	eq(t, "battery absorption voltage", reg.Name)
+
+	r.AddProduct(0xA053, []VERegister{{Address: 0x2211, Name: "custom", Size: RegType_u16}})
+	reg, _ = r.Lookup(0xA053, 0x2211)
+	eq(t, "custom", reg.Name)
+	reg, _ = r.Lookup(0xA060, 0x2211)
+	eq(t, "adjustable voltage minimum", reg.Name)
+
+	x := testHex(HexGet, 0x11, 0x22, 0, 0x20, 0x03)
+	rv, err = ParseHexRecordFor(x, 0xA211)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq(t, "voltage range min", rv.Register.Name)
+	rv, _ = ParseHexRecord(x)
+	eq(t, "adjustable voltage minimum", rv.Register.Name)
+
+	// summaries use the PID of the records
+	sum := summarize([]map[string]interface{}{{"PID": "0xA211"}, {"_x": x}}, false)
+	eq(t, uint16(800), sum["voltage range min"])
+}
+
+func TestVedirectProduct(t *testing.T) {
+	dev := newTestDevice(map[uint16][]byte{0x2211: {0x20, 0x03}})
+	dev.pid = 0xA211
+	out := make(chan map[string]string, 10)
+	v := New(dev, out, Options{HexTimeout: 50 * time.Millisecond})
+	defer v.Close()
+	ctx := context.Background()
+
+	rv, err := v.GetRegister(ctx, 0x2211)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq(t, "adjustable voltage minimum", rv.Register.Name)
+
+	// learned from a text frame
+	dev.send(testFrame("PID", "0xA211", "V", "12800"))
+	<-out
+	eq(t, ProductID(0xA211), v.Product())
+	rv, _ = v.GetRegister(ctx, 0x2211)
+	eq(t, "voltage range min", rv.Register.Name)
+
+	v2 := New(newTestDevice(nil), make(chan map[string]string), Options{Product: 0xA389})
+	defer v2.Close()
+	eq(t, ProductID(0xA389), v2.Product())
+}
@@ -0,0 +1,189 @@
+package vedirect
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// ReplayOptions for reading a capture file at the pace it was recorded, see Options.Replay
+//
+// A capture may be raw serial data, a capture written for Options.Capture, or JSON records as written by vedump or "vesend -post -".
+// Options.Capture captures and JSON records are paced by their recorded times; raw data has no times and is paced at FrameInterval per text record.
+type ReplayOptions struct {
+	// Speed multiplies the original pace, e.g. 10 replays ten times faster. Default 1.
+	Speed float64
+
+	// KeepTime if true keeps the recorded "_t" of JSON records (or uses the recorded time of an Options.Capture capture for Options.AddTime), otherwise "_t" is the time the record is replayed
+	KeepTime bool
+
+	// FrameInterval is the time between text records of a raw capture, default DefaultReplayFrameInterval
+	FrameInterval time.Duration
+}
+
+// DefaultReplayFrameInterval is about how often VE.Direct devices send a text frame
+const DefaultReplayFrameInterval = time.Second
+
+func (ro *ReplayOptions) speed() float64 {
+	if ro.Speed <= 0 {
+		return 1
+	}
+	return ro.Speed
+}
+
+// replayCapture starts replaying r. A file that starts with '{' is JSON records, otherwise the parser reads it.
+func replayCapture(r readOnly, out chan<- map[string]string, opts Options) *Vedirect {
+	cf, ok := r.Reader.(*captureFile)
+	if !ok || !isJSONCapture(cf.Reader) {
+		return New(r, out, opts)
+	}
+	v := newVedirect(out, opts)
+	v.setPort(r)
+	v.wg.Add(1)
+	go v.replayThread(json.NewDecoder(cf))
+	return v
+}
+
+// first non-space byte is '{'
+func isJSONCapture(br *bufio.Reader) bool {
+	for i := 1; ; i++ {
+		peek, err := br.Peek(i)
+		if len(peek) < i {
+			return false
+		}
+		c := peek[i-1]
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			if err != nil {
+				return false
+			}
+			continue
+		}
+		return c == '{'
+	}
+}
+
+func (v *Vedirect) replayThread(dec *json.Decoder) {
+	defer v.exitThread()
+	dec.UseNumber()
+	// running full record per device, for delta encoded vesend messages
+	fulls := make(map[string]map[string]string)
+	for {
+		var obj map[string]interface{}
+		err := dec.Decode(&obj)
+		if err != nil {
+			v.setErr(err)
+			return
+		}
+		// vesend Message {"d":[record, delta, ...]}
+		if deltas, ok := obj["d"].([]interface{}); ok && len(obj) == 1 {
+			for _, d := range deltas {
+				dm, ok := d.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				dk := jsonValueString(dm[DeviceKeyField])
+				full := fulls[dk]
+				if full == nil {
+					full = make(map[string]string)
+					fulls[dk] = full
+				}
+				for k, jv := range dm {
+					full[k] = jsonValueString(jv)
+				}
+				rec := make(map[string]string, len(full))
+				for k, sv := range full {
+					rec[k] = sv
+				}
+				if !v.replayRecord(rec) {
+					return
+				}
+			}
+			continue
+		}
+		rec := make(map[string]string, len(obj))
+		for k, jv := range obj {
+			rec[k] = jsonValueString(jv)
+		}
+		if !v.replayRecord(rec) {
+			return
+		}
+	}
+}
+
+func jsonValueString(jv interface{}) string {
+	switch x := jv.(type) {
+	case string:
+		return x
+	case json.Number:
+		return x.String()
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(jv)
+}
+
+// wait for the record's time, fix up its "_t", send it.
+// false if ctx is done.
+func (v *Vedirect) replayRecord(rec map[string]string) bool {
+	var recorded int64
+	ts, hasTime := rec["_t"]
+	if hasTime {
+		var err error
+		recorded, err = strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			f, ferr := strconv.ParseFloat(ts, 64)
+			if ferr != nil {
+				v.debug("replay: bad _t %#v", ts)
+			}
+			recorded = int64(f)
+		}
+	}
+	if !v.replayWait(recorded) {
+		return false
+	}
+	v.countFrame(&v.stats.Frames)
+	if !(hasTime && v.opts.Replay.KeepTime) && (hasTime || v.AddTime) {
+		rec["_t"] = strconv.FormatInt(time.Now().UnixMilli(), 10)
+	}
+	v.emit(rec)
+	return v.ctx.Err() == nil
+}
+
+// replayWait sleeps until a record recorded at unix milliseconds t is due.
+// t of 0 (unknown) is due FrameInterval after the previous record.
+// Returns false if ctx is done.
+func (v *Vedirect) replayWait(t int64) bool {
+	ro := v.opts.Replay
+	var offset time.Duration
+	if t == 0 {
+		interval := ro.FrameInterval
+		if interval == 0 {
+			interval = DefaultReplayFrameInterval
+		}
+		offset = time.Duration(v.replayCount) * interval
+	} else {
+		if v.replayFirst == 0 {
+			v.replayFirst = t
+		}
+		offset = time.Duration(t-v.replayFirst) * time.Millisecond
+	}
+	v.replayCount++
+	if v.replayStart.IsZero() {
+		v.replayStart = time.Now()
+	}
+	wait := time.Until(v.replayStart.Add(time.Duration(float64(offset) / ro.speed())))
+	if wait <= 0 {
+		return v.ctx.Err() == nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-v.ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,121 @@
+package vedirect
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func writeTemp(t *testing.T, data []byte) string {
+	path := filepath.Join(t.TempDir(), "capture")
+	err := os.WriteFile(path, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func readAll(out <-chan map[string]string) []map[string]string {
+	var recs []map[string]string
+	for rec := range out {
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+func TestReplayRaw(t *testing.T) {
+	var stream []byte
+	for _, v := range []string{"12000", "12010", "12020"} {
+		stream = append(stream, testFrame("PID", "0xA053", "V", v)...)
+	}
+	path := writeTemp(t, stream)
+	out := make(chan map[string]string, 10)
+	start := time.Now()
+	_, err := OpenWithOptions(path, out, Options{AddTime: true, Replay: &ReplayOptions{Speed: 20}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs := readAll(out)
+	elapsed := time.Since(start)
+	eq(t, 3, len(recs))
+	eq(t, "12020", recs[2]["V"])
+	if elapsed < 90*time.Millisecond {
+		t.Errorf("3 frames at 20x took %s, wanted 100ms", elapsed)
+	}
+}
+
+func TestReplayJSON(t *testing.T) {
+	capture := []byte(`{"V": "12000", "_t": "1665000000000"}
+{
+  "V": "12010",
+  "_t": "1665000001000"
+}
+{"V":12020,"_t":1665000002000}
+`)
+	path := writeTemp(t, capture)
+	out := make(chan map[string]string, 10)
+	start := time.Now()
+	v, err := OpenWithOptions(path, out, Options{Replay: &ReplayOptions{Speed: 20, KeepTime: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs := readAll(out)
+	elapsed := time.Since(start)
+	eq(t, 3, len(recs))
+	eq(t, "12020", recs[2]["V"])
+	eq(t, "1665000002000", recs[2]["_t"])
+	if elapsed < 90*time.Millisecond {
+		t.Errorf("2s of records at 20x took %s, wanted 100ms", elapsed)
+	}
+	eq(t, int64(3), v.Stats().Frames)
+
+	// replay time
+	out = make(chan map[string]string, 10)
+	OpenWithOptions(path, out, Options{Replay: &ReplayOptions{Speed: 1000}})
+	recs = readAll(out)
+	ts, _ := strconv.ParseInt(recs[0]["_t"], 10, 64)
+	if time.Since(time.UnixMilli(ts)) > time.Minute {
+		t.Errorf("_t %d not replaced", ts)
+	}
+}
+
+func TestReplayDeltas(t *testing.T) {
+	// vesend -post - messages
+	capture := []byte(`{"d":[{"_t":1665000000000,"V":12000,"I":500},{"_t":1665000001000,"I":600}]}
+{"d":[{"_t":1665000002000,"V":12100}]}`)
+	path := writeTemp(t, capture)
+	out := make(chan map[string]string, 10)
+	OpenWithOptions(path, out, Options{Replay: &ReplayOptions{Speed: 1000, KeepTime: true}})
+	recs := readAll(out)
+	eq(t, 3, len(recs))
+	eq(t, "12000", recs[1]["V"])
+	eq(t, "600", recs[1]["I"])
+	eq(t, "12100", recs[2]["V"])
+	eq(t, "600", recs[2]["I"])
+	eq(t, "1665000002000", recs[2]["_t"])
+}
+
+func TestReplayCancel(t *testing.T) {
+	var stream []byte
+	for i := 0; i < 5; i++ {
+		stream = append(stream, testFrame("V", "12000")...)
+	}
+	path := writeTemp(t, stream)
+	ctx, cf := context.WithCancel(context.Background())
+	out := make(chan map[string]string, 10)
+	v, err := OpenWithOptions(path, out, Options{Context: ctx, Replay: &ReplayOptions{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-out
+	cf()
+	select {
+	case <-v.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancel did not stop replay")
+	}
+	eq(t, context.Canceled, v.Err())
+}
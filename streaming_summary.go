@@ -81,6 +81,9 @@ type StreamingSummary struct {
 	// KeepCount is the number of merged samples to keep
 	KeepCount int
 
+	// Engineering summarizes HEX register values as VERegValue.Engineering() floats, e.g. battery temperature 25.0 (°C) rather than 29815 (0.01 K)
+	Engineering bool
+
 	// binned summaries is sets of summarized data
 	// [N][summaryChunkSize]map[string]interface{}
 	binnedSummaries  [][]map[string]interface{}
@@ -125,7 +128,7 @@ func (sum *StreamingSummary) Add(rec map[string]interface{}) error {
 	}
 	if rec_t > sum.binLimitUnixMilli {
 		// next bin!
-		sum.addSum(summarize(sum.rawRecent[0]))
+		sum.addSum(summarize(sum.rawRecent[0], sum.Engineering))
 		sum.rotateRawRecent()
 		sum.startRR0(rec, rec_t)
 		return nil
@@ -441,6 +444,8 @@ MODE mode
 WARN mode
 MPPT mode
 MON mode
+_c last
+_d last
 _t last
 `
 
@@ -464,20 +469,31 @@ func init() {
 	}
 }
 
-func summarize(they []map[string]interface{}) map[string]interface{} {
+func summarize(they []map[string]interface{}, engineering bool) map[string]interface{} {
 	allKeys := make(map[string]bool)
 	xcount := 0
+	hasLabels := false
 	for _, rec := range they {
 		for k := range rec {
 			allKeys[k] = true
 			if k == "_x" {
 				xcount++
+			} else if isLabelField(k) {
+				hasLabels = true
 			}
 		}
 	}
 	hexKeys := make(map[string]bool)
 	hexThey := make([]map[string]interface{}, 0, xcount)
 	hexModes := make(map[string]string)
+	// HEX registers of the device each record came from, if its text frames were seen, by device key (DeviceKeyField, "" for one device)
+	pids := make(map[string]ProductID)
+	for _, rec := range they {
+		if pid := recordPID(rec); pid != 0 {
+			dk, _ := rec[DeviceKeyField].(string)
+			pids[dk] = pid
+		}
+	}
 	for _, rec := range they {
 		xv, ok := rec["_x"]
 		if !ok {
@@ -487,7 +503,12 @@ func summarize(they []map[string]interface{}) map[string]interface{} {
 		if !ok {
 			continue
 		}
-		value, err := ParseHexRecord(xs)
+		pid := recordPID(rec)
+		if pid == 0 {
+			dk, _ := rec[DeviceKeyField].(string)
+			pid = pids[dk]
+		}
+		value, err := ParseHexRecordFor(xs, pid)
 		if err != nil {
 			continue
 		}
@@ -505,6 +526,11 @@ func summarize(they []map[string]interface{}) map[string]interface{} {
 		hexKeys[value.Register.Name] = true
 		theyrec := make(map[string]interface{}, 1)
 		theyrec[value.Register.Name] = value.Value
+		if engineering {
+			if f, _, err := value.Engineering(); err == nil {
+				theyrec[value.Register.Name] = f
+			}
+		}
 		hexThey = append(hexThey, theyrec)
 	}
 	out := make(map[string]interface{}, len(allKeys)+len(hexKeys))
@@ -512,12 +538,26 @@ func summarize(they []map[string]interface{}) map[string]interface{} {
 	if len(hexKeys) > 0 {
 		summaryInner(hexKeys, hexModes, hexThey, out)
 	}
+	if hasLabels {
+		// labels follow the summarized value
+		AddRecordLabels(out)
+	}
 	return out
 }
 
+// recordPID is the "PID" field of a record, 0 if it has none
+func recordPID(rec map[string]interface{}) ProductID {
+	if ps, ok := rec["PID"].(string); ok {
+		if iv, err := strconv.ParseUint(ps, 0, 16); err == nil {
+			return ProductID(iv)
+		}
+	}
+	return 0
+}
+
 func summaryInner(allKeys map[string]bool, modes map[string]string, they []map[string]interface{}, out map[string]interface{}) {
 	for k := range allKeys {
-		if k == "_x" {
+		if k == "_x" || isLabelField(k) {
 			continue
 		}
 		smode := modes[k]
@@ -557,6 +597,12 @@ func doMean(they []map[string]interface{}, k string, out map[string]interface{})
 		case int32:
 			isum += int64(nv)
 			icount += 1
+		case int8:
+			isum += int64(nv)
+			icount += 1
+		case uint8:
+			isum += int64(nv)
+			icount += 1
 		case uint16:
 			isum += int64(nv)
 			icount += 1
@@ -603,6 +649,21 @@ func doMax(they []map[string]interface{}, k string, out map[string]interface{})
 		case int32:
 			fv = float64(nv)
 			has = true
+		case int16:
+			fv = float64(nv)
+			has = true
+		case int8:
+			fv = float64(nv)
+			has = true
+		case uint32:
+			fv = float64(nv)
+			has = true
+		case uint16:
+			fv = float64(nv)
+			has = true
+		case uint8:
+			fv = float64(nv)
+			has = true
 		case float32:
 			fv = float64(nv)
 			has = true
@@ -642,6 +703,21 @@ func doMin(they []map[string]interface{}, k string, out map[string]interface{})
 		case int32:
 			fv = float64(nv)
 			has = true
+		case int16:
+			fv = float64(nv)
+			has = true
+		case int8:
+			fv = float64(nv)
+			has = true
+		case uint32:
+			fv = float64(nv)
+			has = true
+		case uint16:
+			fv = float64(nv)
+			has = true
+		case uint8:
+			fv = float64(nv)
+			has = true
 		case float32:
 			fv = float64(nv)
 			has = true
@@ -28,7 +28,7 @@ func TestSummarize(t *testing.T) {
 	for i, a := range theys {
 		they[i] = ParseRecord(a)
 	}
-	wat := summarize(they)
+	wat := summarize(they, false)
 	if wat["V"] != float64(30000) {
 		t.Errorf("wat[V] got %#v", wat["V"])
 	}
@@ -121,3 +121,33 @@ func eq(t *testing.T, expected, actual interface{}) {
 	}
 	t.Errorf("wanted %#v, got %#v", expected, actual)
 }
+
+func TestSummarizeRegisterMinMax(t *testing.T) {
+	they := []map[string]interface{}{
+		{"PID": "0xA053"},
+		{"_x": testHex(HexAsync, 0xd3, 0xed, 0, 0x00, 0x01)},
+		{"_x": testHex(HexAsync, 0xd3, 0xed, 0, 0x20, 0x01)},
+		{"_x": testHex(HexAsync, 0xd3, 0xed, 0, 0x10, 0x01)},
+		{"_x": testHex(HexAsync, 0xd2, 0xed, 0, 0x78, 0x00)},
+	}
+	sum := summarize(they, false)
+	// yield today, u16|u32 decoded as uint32
+	eq(t, float64(0x120), sum["yield today"])
+	// maximum power today, u16
+	eq(t, float64(120), sum["maximum power today"])
+	sum = summarize(they, true)
+	eq(t, 2.88, sum["yield today"])
+}
+
+func TestSummarizeDevices(t *testing.T) {
+	// a Manager stream of an MPPT and a BMV, each HEX record decoded with its own device's registers
+	they := []map[string]interface{}{
+		{"PID": "0xA053", "V": int64(13800), DeviceKeyField: "HQ1234ABCDE"},
+		{"_x": testHex(HexAsync, 0xf7, 0xed, 0, 0xa0, 0x05), DeviceKeyField: "HQ1234ABCDE"},
+		{"_x": testHex(HexAsync, 0xff, 0x0f, 0, 0x10, 0x27), DeviceKeyField: "/dev/ttyUSB1"},
+		{"PID": "0xA389", "V": int64(13100), DeviceKeyField: "/dev/ttyUSB1"},
+	}
+	sum := summarize(they, false)
+	eq(t, uint16(1440), sum["battery absorption voltage"])
+	eq(t, float64(10000), sum["state of charge"])
+}
@@ -0,0 +1,82 @@
+package vedirect
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrUnitConversion = errors.New("can't convert units")
+
+// unitDef is a whole unit, value in dim units = v*scale + offset
+type unitDef struct {
+	dim    string
+	scale  float64
+	offset float64
+}
+
+// whole units ConvertUnit knows, as used by IntFields and the register tables
+var wholeUnits = map[string]unitDef{
+	"V":       {"V", 1, 0},
+	"A":       {"A", 1, 0},
+	"Ah":      {"Ah", 1, 0},
+	"W":       {"W", 1, 0},
+	"kW":      {"W", 1000, 0},
+	"Wh":      {"Wh", 1, 0},
+	"kWh":     {"Wh", 1000, 0},
+	"VA":      {"VA", 1, 0},
+	"kVA":     {"VA", 1000, 0},
+	"VAh":     {"VAh", 1, 0},
+	"kVAh":    {"VAh", 1000, 0},
+	"K":       {"K", 1, 0},
+	"°C":      {"K", 1, 273.15},
+	"°F":      {"K", 5.0 / 9.0, 273.15 - 32*5.0/9.0},
+	"s":       {"s", 1, 0},
+	"seconds": {"s", 1, 0},
+	"Seconds": {"s", 1, 0},
+	"min":     {"s", 60, 0},
+	"Minutes": {"s", 60, 0},
+	"hours":   {"s", 3600, 0},
+	"%":       {"%", 1, 0},
+	"‰":       {"%", 0.1, 0},
+}
+
+// engineeringUnits is the unit Engineering values are given in, if not the register's own
+var engineeringUnits = map[string]string{
+	"K": "°C",
+}
+
+// unitDivisor splits a unit description into the divisor to its whole unit and the whole unit.
+// e.g. "mV" -> (1000, "V"), "0.01kWh" -> (100, "kWh"), "min" -> (1, "min")
+func unitDivisor(unit string) (float64, string) {
+	if strings.HasPrefix(unit, "0.1") {
+		return 10.0, unit[3:]
+	}
+	if strings.HasPrefix(unit, "0.01") {
+		return 100.0, unit[4:]
+	}
+	if len(unit) > 1 && unit[0] == 'm' {
+		if _, ok := wholeUnits[unit[1:]]; ok {
+			return 1000.0, unit[1:]
+		}
+	}
+	return 1.0, unit
+}
+
+// ConvertUnit converts v from one unit to another, e.g. (1382, "0.01V", "V") -> 13.82, (298.15, "K", "°C") -> 25
+//
+// Units may have a "m", "0.1" or "0.01" prefix as in IntFields.
+func ConvertUnit(v float64, from, to string) (float64, error) {
+	fd, fu := unitDivisor(from)
+	td, tu := unitDivisor(to)
+	v = v / fd
+	if fu != tu {
+		fdef, fok := wholeUnits[fu]
+		tdef, tok := wholeUnits[tu]
+		if !fok || !tok || fdef.dim != tdef.dim {
+			return 0, fmt.Errorf("%w %#v to %#v", ErrUnitConversion, from, to)
+		}
+		v = (v*fdef.scale + fdef.offset - tdef.offset) / tdef.scale
+	}
+	return v * td, nil
+}
@@ -0,0 +1,61 @@
+package vedirect
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+var convertCases = []struct {
+	v        float64
+	from, to string
+	out      float64
+}{
+	{1382, "0.01V", "V", 13.82},
+	{13.82, "V", "mV", 13820},
+	{1250, "Wh", "kWh", 1.25},
+	{123, "0.01kWh", "Wh", 1230},
+	{298.15, "K", "°C", 25},
+	{100, "°C", "°F", 212},
+	{90, "min", "hours", 1.5},
+	{500, "‰", "%", 50},
+	{7, "farts", "farts", 7},
+}
+
+func TestConvertUnit(t *testing.T) {
+	for i, tc := range convertCases {
+		out, err := ConvertUnit(tc.v, tc.from, tc.to)
+		if err != nil {
+			t.Errorf("[%d] %v", i, err)
+			continue
+		}
+		if math.Abs(out-tc.out) > 1e-9 {
+			t.Errorf("[%d] %f %s -> %f %s, wanted %f", i, tc.v, tc.from, out, tc.to, tc.out)
+		}
+	}
+	_, err := ConvertUnit(1, "V", "A")
+	eq(t, true, errors.Is(err, ErrUnitConversion))
+	_, err = ConvertUnit(1, "farts", "V")
+	eq(t, true, errors.Is(err, ErrUnitConversion))
+}
+
+func TestRegisterUnits(t *testing.T) {
+	// yield yesterday 1.23 kWh
+	rv, err := ParseHexRecordFor(testHex(HexGet, 0xd1, 0xed, 0, 0x7b, 0x00), 0xA053)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq(t, "1.23 kWh", rv.String())
+	wh, err := rv.In("Wh")
+	eq(t, nil, err)
+	if math.Abs(wh-1230) > 1e-9 {
+		t.Errorf("wanted 1230 Wh, got %f", wh)
+	}
+	for _, reg := range VE_MPPT_Registers() {
+		if reg.Unit != "" && reg.Unit != "% of max current" && reg.Unit != "mV/K" {
+			if _, ok := wholeUnits[reg.Unit]; !ok {
+				t.Errorf("register 0x%04x %s unknown unit %#v", reg.Address, reg.Name, reg.Unit)
+			}
+		}
+	}
+}
@@ -7,12 +7,11 @@ package vedirect
 import (
 	"bufio"
 	"context"
-	ehex "encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
-	"log"
+	"net"
 	"os"
 	"reflect"
 	"strconv"
@@ -57,6 +56,83 @@ const (
 	AddTime Option = 1
 )
 
+// DefaultBaud is the VE.Direct serial speed
+const DefaultBaud = 19200
+
+// Options for New() and OpenWithOptions()
+type Options struct {
+	// Baud is the serial speed for char devices opened by OpenWithOptions, default DefaultBaud
+	Baud int
+
+	// AddTime if true will add to each record {"_t": time.Now().UnixMilli()}
+	AddTime bool
+
+	// Debug output, may be nil
+	Debug io.Writer
+
+	// WaitGroup may be nil. If set, Add(1) when the read thread starts and Done() when it exits.
+	WaitGroup *sync.WaitGroup
+
+	// Context stops the read thread, may be nil for context.Background()
+	Context context.Context
+
+	// MergeBlocks if true assembles the blocks of one transmission cycle into one record.
+	// BMV battery monitors send live values and H1..H18 history as separate checksummed blocks.
+	// Products that send one block are passed through unchanged.
+	MergeBlocks bool
+
+	// Reconnect if true makes OpenWithOptions reopen the device path after a read error (e.g. USB cable unplugged), with backoff.
+	// Connection changes are sent on the out channel as {"_c": ConnLost} and {"_c": ConnReconnected} records.
+	Reconnect bool
+
+	// ReconnectMaxWait is the longest time between reopen attempts, default DefaultReconnectMaxWait
+	ReconnectMaxWait time.Duration
+
+	// HexTimeout is how long GetRegister etc wait for a response before resending, default DefaultHexTimeout
+	HexTimeout time.Duration
+
+	// HexRetries is how many times GetRegister etc resend after a timeout, default DefaultHexRetries, negative for none
+	HexRetries int
+
+	// Replay if set makes OpenWithOptions pace records from a capture file like the original device, instead of reading as fast as possible
+	Replay *ReplayOptions
+
+	// Capture if set receives a timestamped copy of all bytes read from and written to the device, see CaptureReader
+	Capture io.Writer
+
+	// RecordPool if set supplies the maps of parsed records.
+	// The receiver may Put each record back to the pool when it is done with it, so the next record reuses it.
+	RecordPool *RecordPool
+
+	// Product is the PID of the device if known before it sends a text frame, for decoding register values
+	Product ProductID
+
+	// Registry of register tables, default DefaultRegistry
+	Registry *Registry
+
+	// AsyncUpdatesRegister is the register SetAsyncUpdates writes, which depends on the product and firmware
+	AsyncUpdatesRegister *VERegister
+}
+
+// DefaultReconnectMaxWait is the default for Options.ReconnectMaxWait
+const DefaultReconnectMaxWait = time.Minute
+
+var reconnectMinWait = time.Second
+
+// ConnState is the value of the "_c" field of connection state records from a Reconnect Vedirect
+type ConnState string
+
+const (
+	// ConnConnected is sent when the device is first opened
+	ConnConnected ConnState = "connected"
+
+	// ConnLost is sent when a read fails, no records will come until ConnReconnected
+	ConnLost ConnState = "lost"
+
+	// ConnReconnected is sent when the device path has been reopened
+	ConnReconnected ConnState = "reconnected"
+)
+
 type Vedirect struct {
 	// AddTime if true will add to each record {"_t": time.Now().UnixMilli()}
 	AddTime bool
@@ -70,10 +146,16 @@ type Vedirect struct {
 
 	ctx context.Context
 
+	// cancel ctx, for Close()
+	cancel context.CancelFunc
+
 	bytesSum uint
 
 	data map[string]string
 
+	// first block of a multi-block transmission, see Options.MergeBlocks
+	pending map[string]string
+
 	out chan<- map[string]string
 
 	key []byte
@@ -82,9 +164,100 @@ type Vedirect struct {
 
 	hexMessage []byte
 
+	// decoded hexMessage
+	hexBytes []byte
+
+	// last "_x", reused if the next is the same
+	lastHex string
+
+	// last value of each field, reused while it doesn't change
+	values map[string]string
+
+	// field names not in internedKeys, see internKey
+	keys map[string]string
+
+	// fields in the last text block, to size the next record
+	recordSize int
+
 	state vedState
 
+	// state to return to after a HEX line
+	textState vedState
+
 	wg *sync.WaitGroup
+
+	// closed when readThread exits
+	done chan struct{}
+
+	// l protects fin, closeOnce, err, stats and product
+	l sync.Mutex
+
+	// closes fin exactly once, replaced with each new port by setPort
+	closeOnce *sync.Once
+
+	// why readThread exited
+	err error
+
+	stats Stats
+
+	// PID of the device, see Product()
+	product ProductID
+
+	// hl protects waiters, subs, subsAll
+	hl sync.Mutex
+
+	// HEX requests waiting for a response, oldest first, see GetRegister
+	waiters []hexWaiter
+
+	// async register update subscribers, see Subscribe
+	subs    map[uint16][]chan<- RegisterUpdate
+	subsAll []chan<- RegisterUpdate
+
+	// wl serializes writes
+	wl sync.Mutex
+
+	// dl serializes requests answered by a Done response
+	dl sync.Mutex
+
+	// Options.Replay pacing, see replayWait
+	replayStart time.Time
+	replayFirst int64
+	replayCount int64
+
+	// Options.Capture
+	capture *captureWriter
+
+	// set if reading a capture with recorded times
+	timed *CaptureReader
+
+	// for Options.Reconnect
+	path   string
+	opts   Options
+	reopen func() (io.ReadWriter, error)
+}
+
+// Stats counts what the parser has seen, see Vedirect.Stats()
+type Stats struct {
+	// BytesRead from the device
+	BytesRead int64 `json:"bytes"`
+
+	// Frames is the count of good text protocol frames
+	Frames int64 `json:"frames"`
+
+	// ChecksumErrors is the count of text protocol frames dropped for bad checksum
+	ChecksumErrors int64 `json:"cserr"`
+
+	// HexFrames is the count of good HEX protocol messages
+	HexFrames int64 `json:"hex"`
+
+	// HexErrors is the count of HEX protocol messages dropped for bad hex or bad checksum
+	HexErrors int64 `json:"hexerr"`
+
+	// LastFrame is when the last good text or HEX frame was received
+	LastFrame time.Time `json:"last"`
+
+	// Reconnects is the count of times the device was reopened (Options.Reconnect)
+	Reconnects int64 `json:"reconn,omitempty"`
 }
 
 // Open a VE.Direct serial device (starts a thread).
@@ -93,48 +266,219 @@ type Vedirect struct {
 // wg may be nil.
 // debugOut may be nil.
 func Open(path string, out chan<- map[string]string, wg *sync.WaitGroup, ctx context.Context, debugOut io.Writer, options ...Option) (v *Vedirect, err error) {
-	v = new(Vedirect)
-	v.dout = debugOut
+	opts := Options{
+		Debug:     debugOut,
+		WaitGroup: wg,
+		Context:   ctx,
+	}
+	for _, opt := range options {
+		if opt == AddTime {
+			opts.AddTime = true
+		}
+	}
+	return OpenWithOptions(path, out, opts)
+}
+
+// OpenWithOptions opens a VE.Direct device and starts a read thread.
+//
+// path may be:
+//   - a serial char device, opened at opts.Baud
+//   - "tcp://host:port" for a serial-to-network adapter
+//   - a named pipe, opened read-write
+//   - a regular file of captured serial data, read only (SendHexCommand will return ErrNoOutput).
+//     It may also be a capture written for Options.Capture, or with opts.Replay JSON records as written by vedump, see ReplayOptions.
+func OpenWithOptions(path string, out chan<- map[string]string, opts Options) (v *Vedirect, err error) {
+	rw, err := openPath(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	_, isCapture := rw.(readOnly)
+	if isCapture && opts.Replay != nil {
+		return replayCapture(rw.(readOnly), out, opts), nil
+	}
+	if isCapture || !opts.Reconnect {
+		return New(rw, out, opts), nil
+	}
+	v = newVedirect(out, opts)
+	v.path = path
+	v.reopen = func() (io.ReadWriter, error) {
+		return openPath(path, opts)
+	}
+	v.setPort(rw)
+	v.start()
+	return v, nil
+}
+
+func openPath(path string, opts Options) (rw io.ReadWriter, err error) {
+	v := Vedirect{dout: opts.Debug}
+	if strings.HasPrefix(path, "tcp://") {
+		v.debug("%s: dial", path)
+		rw, err = net.Dial("tcp", path[len("tcp://"):])
+		if err != nil {
+			v.debug("%s: could not dial, %v", path, err)
+		}
+		return
+	}
 	st, err := os.Stat(path)
 	if err != nil {
 		v.debug("%s: could not stat, %v", path, err)
 		return nil, err
 	}
-	if (st.Mode() & charDevice) == charDevice {
+	mode := st.Mode()
+	if (mode & charDevice) == charDevice {
 		v.debug("%s: is char device", path)
-		sc := serial.Config{Name: path, Baud: 19200}
-		dev, derr := serial.OpenPort(&sc)
-		err = derr
-		v.fin = dev
-		v.fout = dev
-
+		baud := opts.Baud
+		if baud == 0 {
+			baud = DefaultBaud
+		}
+		sc := serial.Config{Name: path, Baud: baud, ReadTimeout: serialReadTimeout}
+		var port *serial.Port
+		port, err = serial.OpenPort(&sc)
+		if err == nil {
+			rw = &serialPort{port: port}
+		}
+	} else if (mode & fs.ModeNamedPipe) != 0 {
+		v.debug("%s: is named pipe", path)
+		rw, err = os.OpenFile(path, os.O_RDWR, 0)
 	} else {
-		v.debug("%s: is not char device, assuming debug file capture")
-		fin, ferr := os.OpenFile(path, os.O_RDONLY, 0777)
-		err = ferr
-		v.fin = fin
+		v.debug("%s: is not char device, assuming debug file capture", path)
+		var fin *os.File
+		fin, err = os.OpenFile(path, os.O_RDONLY, 0777)
+		if err == nil {
+			rw, err = openCaptureFile(fin)
+		}
 	}
 	if err != nil {
 		v.debug("%s: could not open, %v", path, err)
 		return nil, err
 	}
-	v.ctx = ctx
-	if v.ctx == nil {
-		v.ctx = context.Background()
+	return rw, nil
+}
+
+// New starts a VE.Direct parser reading from rw (starts a thread).
+//
+// rw may be a serial port, network connection, pipe, or an in-memory buffer for tests.
+// HEX commands are written to rw.
+// If rw is an io.Closer it is closed when the read thread exits.
+// out chan receives data.
+// opts.Baud is ignored, the transport is already set up.
+func New(rw io.ReadWriter, out chan<- map[string]string, opts Options) *Vedirect {
+	v := newVedirect(out, opts)
+	v.setPort(rw)
+	v.start()
+	return v
+}
+
+func (v *Vedirect) setPort(rw io.ReadWriter) {
+	v.l.Lock()
+	defer v.l.Unlock()
+	v.fin = rw
+	v.closeOnce = new(sync.Once)
+	if ro, isReadOnly := rw.(readOnly); isReadOnly {
+		v.fout = nil
+		v.timed, _ = ro.Reader.(*CaptureReader)
+	} else {
+		v.fout = rw
+	}
+}
+
+func (v *Vedirect) writer() io.Writer {
+	v.l.Lock()
+	defer v.l.Unlock()
+	return v.fout
+}
+
+// NewReader starts a VE.Direct parser reading from r (starts a thread).
+// There is no way to send HEX commands, SendHexCommand will return ErrNoOutput.
+func NewReader(r io.Reader, out chan<- map[string]string, opts Options) *Vedirect {
+	return New(readOnly{r}, out, opts)
+}
+
+func newVedirect(out chan<- map[string]string, opts Options) *Vedirect {
+	v := new(Vedirect)
+	v.opts = opts
+	v.AddTime = opts.AddTime
+	v.dout = opts.Debug
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
 	}
+	v.ctx, v.cancel = context.WithCancel(ctx)
 	v.out = out
-	v.wg = wg
+	v.wg = opts.WaitGroup
 	if v.wg == nil {
 		v.wg = new(sync.WaitGroup)
 	}
+	v.done = make(chan struct{})
+	v.product = opts.Product
+	if opts.Capture != nil {
+		v.capture = newCaptureWriter(opts.Capture)
+	}
+	return v
+}
+
+func (v *Vedirect) start() {
 	v.wg.Add(1)
-	for _, opt := range options {
-		if opt == AddTime {
-			v.AddTime = true
+	go v.readThread()
+}
+
+// serialReadTimeout bounds how long a Read on a serial device blocks, so that Close() and Context can stop the read thread.
+// (Closing a blocking tty doesn't interrupt a pending read.)
+const serialReadTimeout = 500 * time.Millisecond
+
+var ErrHangup = errors.New("serial device hung up")
+
+// serialPort adapts tarm/serial with ReadTimeout, where a read timeout looks like (0, io.EOF)
+type serialPort struct {
+	port *serial.Port
+
+	// count of reads that returned nothing well before the timeout
+	fastEmpty int
+}
+
+// Read returns (0, nil) on timeout.
+// A hung up tty (e.g. USB unplugged) returns nothing immediately, forever, which becomes ErrHangup.
+func (sp *serialPort) Read(b []byte) (int, error) {
+	start := time.Now()
+	n, err := sp.port.Read(b)
+	if n == 0 && errors.Is(err, io.EOF) {
+		if time.Since(start) < serialReadTimeout/4 {
+			sp.fastEmpty++
+			if sp.fastEmpty >= 3 {
+				return 0, ErrHangup
+			}
+		} else {
+			sp.fastEmpty = 0
 		}
+		return 0, nil
 	}
-	go v.readThread()
-	return v, nil
+	sp.fastEmpty = 0
+	return n, err
+}
+
+func (sp *serialPort) Write(b []byte) (int, error) {
+	return sp.port.Write(b)
+}
+
+func (sp *serialPort) Close() error {
+	return sp.port.Close()
+}
+
+// readOnly marks a reader with no write side
+type readOnly struct {
+	io.Reader
+}
+
+func (ro readOnly) Write(b []byte) (int, error) {
+	return 0, ErrNoOutput
+}
+
+func (ro readOnly) Close() error {
+	rc, ok := ro.Reader.(io.Closer)
+	if ok {
+		return rc.Close()
+	}
+	return nil
 }
 
 func (v *Vedirect) debug(msg string, args ...interface{}) {
@@ -154,102 +498,6 @@ type statFile interface {
 
 const charDevice = fs.ModeDevice | fs.ModeCharDevice
 
-// handle achieves parsing VE.Direct status messages
-// lines are mostly text except Checksum byte:
-// "\r\n{key}\t{value}"
-// "\r\nChecksum\t{cs byte}"
-// {cs byte} + {all bytes through "\r\n" after previous csbyte} == 0x00
-//
-// HEX protocol line:
-// :{command nybble}{[xx] hex bytes...}{cs byte}\n
-// 0x0{command nybble} + bytes + cs byte == 0x55
-func (v *Vedirect) handle(b uint8) {
-	if b == hexmarker && v.state != inChecksum {
-		v.state = hex
-		v.hexMessage = make([]byte, 1, 20)
-		v.hexMessage[0] = '0' // prefix for command nybble
-		return
-	}
-
-	v.bytesSum += uint(b)
-	switch v.state {
-	case waitHeader:
-		if b == '\n' {
-			v.state = inKey
-		}
-	case inKey:
-		if b == delimiter {
-			if string(v.key) == "Checksum" {
-				v.state = inChecksum
-			} else {
-				v.state = inValue
-			}
-		} else {
-			v.key = append(v.key, b)
-		}
-	case inValue:
-		if b == '\r' {
-			v.state = waitHeader
-			if v.data == nil {
-				v.data = make(map[string]string)
-			}
-			v.data[string(v.key)] = string(v.value)
-			v.key = nil
-			v.value = nil
-		} else {
-			v.value = append(v.value, b)
-		}
-	case inChecksum:
-		v.key = nil
-		v.value = nil
-		v.state = waitHeader
-		if v.bytesSum%256 == 0 {
-			if v.AddTime {
-				v.data["_t"] = strconv.FormatInt(time.Now().UnixMilli(), 10)
-			}
-			v.out <- v.data
-			v.data = nil
-		}
-		v.bytesSum = 0
-	case hex:
-		v.bytesSum = 0
-		if b == '\n' {
-			v.finishHexMessage()
-			v.state = waitHeader
-		} else {
-			// accumulate nybbles, parse at end
-			v.hexMessage = append(v.hexMessage, b)
-		}
-	default:
-		panic("bad state")
-	}
-}
-
-func (v *Vedirect) finishHexMessage() {
-	blen := len(v.hexMessage) / 2
-	hbytes := make([]byte, blen)
-	count, err := ehex.Decode(hbytes, v.hexMessage)
-	if err != nil {
-		log.Printf("bad HEX message, %v", err)
-		log.Printf("hexbyte: %s", ehex.EncodeToString(v.hexMessage))
-		return
-	}
-	var hexSum uint
-	for _, c := range hbytes[:count] {
-		hexSum += uint(c)
-	}
-	if hexSum&0x0ff != 0x055 {
-		log.Printf("bad HEX checksum, 0x%02x != 0x55", hexSum&0x0ff)
-		return
-	}
-	data := make(map[string]string)
-	if v.AddTime {
-		data["_t"] = strconv.FormatInt(time.Now().UnixMilli(), 10)
-	}
-	data["_x"] = string(v.hexMessage)
-	v.out <- data
-}
-
 var ErrNoOutput = errors.New("no output configured")
 
 // SendHexCommand sends a HEX protocol command to a VE.Direct device.
@@ -260,62 +508,314 @@ var ErrNoOutput = errors.New("no output configured")
 //
 // Actual message fields vary by length and content and are left to application code, but you might want "encoding/binary" LittleEndian.Uint16([]byte) and .PutUint16([]byte, uint16)
 func (v *Vedirect) SendHexCommand(cmd Command, msg []byte) error {
-	if v.fout == nil {
+	fout := v.writer()
+	if fout == nil {
 		v.debug("could not send hex command, null out")
 		return ErrNoOutput
 	}
 	command := formatHexCommand(cmd, msg)
-	_, err := v.fout.Write(command)
+	v.wl.Lock()
+	defer v.wl.Unlock()
+	_, err := fout.Write(command)
+	if v.capture != nil {
+		v.capture.chunk(true, command)
+	}
 	return err
 }
 
 func formatHexCommand(cmd Command, msg []byte) []byte {
-	hexSum := uint(cmd)
-	out := make([]byte, 4+(len(msg)*2))
-	wat := []byte{byte(cmd)}
-	for _, c := range msg {
-		hexSum += uint(c)
+	return appendHexLine(nil, byte(cmd), msg)
+}
+
+func (v *Vedirect) readThread() {
+	defer v.exitThread()
+	go v.interruptThread()
+	if v.reopen != nil {
+		v.sendConnState(ConnConnected)
 	}
-	cs := (0x055 - (hexSum & 0x0ff)) & 0x0ff
-	if (cs+hexSum)&0x0ff != 0x055 {
-		panic("can't generate a cs")
+	buf := make([]byte, 4096)
+	for {
+		if v.ctx.Err() != nil {
+			v.setErr(v.ctx.Err())
+			return
+		}
+		n, err := v.fin.Read(buf)
+		if n > 0 {
+			v.l.Lock()
+			v.stats.BytesRead += int64(n)
+			v.l.Unlock()
+			if v.capture != nil {
+				v.capture.chunk(false, buf[:n])
+			}
+			if v.opts.Replay != nil && v.timed != nil && !v.replayWait(v.timed.Time().UnixMilli()) {
+				continue
+			}
+		}
+		v.handleBytes(buf[:n])
+		if err != nil {
+			if v.ctx.Err() != nil {
+				// read was interrupted by Close() or Context
+				v.setErr(v.ctx.Err())
+				return
+			}
+			v.debug("ve read err: %v", err)
+			if v.reopen != nil && v.reconnect(err) {
+				continue
+			}
+			if v.Err() == nil {
+				v.setErr(err)
+			}
+			return
+		}
 	}
-	ehex.Encode(out, wat)
-	ehex.Encode(out[2:], msg)
-	wat[0] = uint8(cs & 0x0ff)
-	ehex.Encode(out[2+(len(msg)*2):], wat)
-	upper := strings.ToUpper(string(out[1:]))
-	command := fmt.Sprintf(":%s\n", upper)
-	return []byte(command)
 }
 
-func (v *Vedirect) readThread() {
-	fc, ok := v.fin.(io.Closer)
+// cleanup at the end of readThread or replayThread
+func (v *Vedirect) exitThread() {
+	v.flushPending()
+	v.cancel()
+	// closed before Close returns, so the path can be reopened right away
+	v.closePort()
+	close(v.out)
+	close(v.done)
+	if v.wg != nil {
+		v.wg.Done()
+	}
+}
+
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error // os.File and net.Conn have this
+}
+
+// when ctx is done, unblock a pending Read
+func (v *Vedirect) interruptThread() {
+	<-v.ctx.Done()
+	port := v.port()
+	rd, ok := port.(readDeadliner)
 	if ok {
-		defer fc.Close()
+		rd.SetReadDeadline(time.Now())
 	}
-	if v.wg != nil {
-		defer v.wg.Done()
+	v.closePort()
+}
+
+// closePort closes the current port if it hasn't been already
+func (v *Vedirect) closePort() {
+	v.l.Lock()
+	port, once := v.fin, v.closeOnce
+	v.l.Unlock()
+	once.Do(func() { closeIfCloser(port) })
+}
+
+func (v *Vedirect) port() io.Reader {
+	v.l.Lock()
+	defer v.l.Unlock()
+	return v.fin
+}
+
+// Close stops the read thread, closes the device, and waits for the read thread to exit.
+func (v *Vedirect) Close() error {
+	v.cancel()
+	<-v.done
+	return nil
+}
+
+func closeIfCloser(x any) {
+	fc, ok := x.(io.Closer)
+	if ok {
+		fc.Close()
+	}
+}
+
+// reconnect after read error, return false if Context is done
+func (v *Vedirect) reconnect(err error) bool {
+	v.setErr(err)
+	v.sendConnState(ConnLost)
+	v.closePort()
+	v.resetParser()
+	wait := reconnectMinWait
+	maxWait := v.opts.ReconnectMaxWait
+	if maxWait == 0 {
+		maxWait = DefaultReconnectMaxWait
 	}
 	done := v.ctx.Done()
-	buf := make([]byte, 4096)
 	for {
+		timer := time.NewTimer(wait)
 		select {
 		case <-done:
-			return
-		default:
+			timer.Stop()
+			v.setErr(v.ctx.Err())
+			return false
+		case <-timer.C:
 		}
-		n, err := v.fin.Read(buf)
-		if err != nil {
-			// TODO: capture error back to Vedirect.err or something?
-			log.Printf("ve read err: %v", err)
-			close(v.out)
-			return
+		rw, err := v.reopen()
+		if err == nil {
+			v.debug("%s: reconnected", v.path)
+			v.setPort(rw)
+			if v.ctx.Err() != nil {
+				// interruptThread may have missed the new port
+				v.closePort()
+				v.setErr(v.ctx.Err())
+				return false
+			}
+			v.l.Lock()
+			v.err = nil
+			v.stats.Reconnects++
+			v.l.Unlock()
+			v.sendConnState(ConnReconnected)
+			return true
+		}
+		v.setErr(err)
+		wait *= 2
+		if wait > maxWait {
+			wait = maxWait
+		}
+	}
+}
+
+func (v *Vedirect) resetParser() {
+	v.flushPending()
+	v.state = waitHeader
+	v.data = nil
+	v.key = v.key[:0]
+	v.value = v.value[:0]
+	v.bytesSum = 0
+}
+
+func (v *Vedirect) sendConnState(cs ConnState) {
+	data := make(map[string]string, 2)
+	if v.AddTime {
+		data["_t"] = strconv.FormatInt(time.Now().UnixMilli(), 10)
+	}
+	data["_c"] = string(cs)
+	if v.capture != nil {
+		if err := v.Err(); cs == ConnLost && err != nil {
+			v.capture.comment("%s, %v", cs, err)
+		} else {
+			v.capture.comment("%s", cs)
+		}
+	}
+	v.emit(data)
+}
+
+// textBlock handles a checksummed text block, merging multi-block transmissions if Options.MergeBlocks
+func (v *Vedirect) textBlock(data map[string]string) {
+	if pid, ok := data["PID"]; ok {
+		v.notePID(pid)
+	}
+	if !v.opts.MergeBlocks {
+		v.emitText(data)
+		return
+	}
+	pid, hasPID := data["PID"]
+	if hasPID {
+		// start of a transmission cycle
+		v.flushPending()
+		if isMultiBlockPID(pid) {
+			v.pending = data
+		} else {
+			v.emitText(data)
 		}
-		for i := 0; i < n; i++ {
-			v.handle(buf[i])
+		return
+	}
+	if v.pending != nil {
+		// second block, e.g. BMV history H1..H18
+		for k, val := range data {
+			v.pending[k] = val
 		}
+		v.putRecord(data)
+		data = v.pending
+		v.pending = nil
+	}
+	v.emitText(data)
+}
+
+// remember the PID from a text frame
+func (v *Vedirect) notePID(pid string) {
+	iv, err := strconv.ParseUint(pid, 0, 16)
+	if err != nil {
+		return
+	}
+	v.l.Lock()
+	defer v.l.Unlock()
+	v.product = ProductID(iv)
+}
+
+// isMultiBlockPID is true for products that send their text data as more than one checksummed block
+func isMultiBlockPID(pid string) bool {
+	iv, err := strconv.ParseUint(pid, 0, 16)
+	if err != nil {
+		return false
 	}
+	return ProductFamilyForPID(ProductID(iv)) == FamilyBMV
+}
+
+// send a held first block on its own
+func (v *Vedirect) flushPending() {
+	if v.pending != nil {
+		v.emitText(v.pending)
+		v.pending = nil
+	}
+}
+
+func (v *Vedirect) emitText(data map[string]string) {
+	if v.opts.Replay != nil && v.timed == nil && !v.replayWait(0) {
+		return
+	}
+	if v.AddTime {
+		t := time.Now()
+		if v.timed != nil && v.opts.Replay != nil && v.opts.Replay.KeepTime {
+			t = v.timed.Time()
+		}
+		data["_t"] = strconv.FormatInt(t.UnixMilli(), 10)
+	}
+	v.emit(data)
+}
+
+// send a record to out unless ctx is done
+func (v *Vedirect) emit(data map[string]string) {
+	select {
+	case v.out <- data:
+	case <-v.ctx.Done():
+	}
+}
+
+func (v *Vedirect) setErr(err error) {
+	v.l.Lock()
+	defer v.l.Unlock()
+	v.err = err
+}
+
+func (v *Vedirect) countFrame(counter *int64) {
+	v.l.Lock()
+	defer v.l.Unlock()
+	*counter++
+	v.stats.LastFrame = time.Now()
+}
+
+func (v *Vedirect) countError(counter *int64) {
+	v.l.Lock()
+	defer v.l.Unlock()
+	*counter++
+}
+
+// Done returns a channel that is closed when the read thread exits, after which Err() says why.
+func (v *Vedirect) Done() <-chan struct{} {
+	return v.done
+}
+
+// Err returns why the read thread exited: the read error (io.EOF at the end of a capture file), or the Context error.
+// Err returns nil while still running, except with Options.Reconnect it is the last error while disconnected.
+func (v *Vedirect) Err() error {
+	v.l.Lock()
+	defer v.l.Unlock()
+	return v.err
+}
+
+// Stats returns a snapshot of parser counters.
+func (v *Vedirect) Stats() Stats {
+	v.l.Lock()
+	defer v.l.Unlock()
+	return v.stats
 }
 
 // from "VE.Direct Protocol" text protocol spec
@@ -382,6 +882,9 @@ MODE
 WARN
 MPPT
 MON
+_x
+_c
+_d
 `
 
 // IntFields map field name to unit description (if any).
@@ -420,6 +923,7 @@ func init() {
 		}
 		OtherFields[line] = true
 	}
+	initInternedKeys()
 }
 
 var ParseRecordDebug io.Writer
@@ -441,7 +945,7 @@ func ParseRecord(rec map[string]string) map[string]interface{} {
 				nrec[k] = v
 			}
 		} else {
-			knownOther := OtherFields[k]
+			knownOther := OtherFields[k] || isLabelField(k)
 			if !knownOther {
 				debug := ParseRecordDebug
 				if debug != nil {
@@ -475,7 +979,7 @@ func ParseRecordFieldString(k, v string) any {
 			}
 		}
 	} else {
-		knownOther := OtherFields[k]
+		knownOther := OtherFields[k] || isLabelField(k)
 		if !knownOther {
 			debug := ParseRecordDebug
 			if debug != nil {
@@ -492,19 +996,11 @@ func ParseRecordFieldString(k, v string) any {
 // If there was no conversion, unit returned is same as passed in.
 func FloatWholeUnits(v int64, unit string) (float64, string) {
 	// "mV" "mA" "mAh" "0.01kWh" "0.01V" "0.1A"
-	if unit == "" {
+	div, whole := unitDivisor(unit)
+	if div == 1 {
 		return float64(v), unit
 	}
-	if unit[0] == 'm' {
-		return float64(v) / 1000.0, unit[1:]
-	}
-	if strings.HasPrefix(unit, "0.1") {
-		return float64(v) / 10.0, unit[3:]
-	}
-	if strings.HasPrefix(unit, "0.01") {
-		return float64(v) / 100.0, unit[4:]
-	}
-	return float64(v), unit
+	return float64(v) / div, whole
 }
 
 func stringRecDiff(a, b map[string]string) map[string]string {
@@ -533,6 +1029,7 @@ func stringRecDiff(a, b map[string]string) map[string]string {
 
 // StringRecordDeltas makes a list of deltas.
 // The first record has all its fields, each record after only has fields that have changed.
+// Records with a DeviceKeyField are diffed against the previous record from the same device, and keep the device key.
 // passed in deltas object is appeneded to, or may be nil.
 // Output records have ParseRecord applied
 func StringRecordDeltas(batch []map[string]string, deltas []map[string]interface{}, keyframePeriod int) []map[string]interface{} {
@@ -540,8 +1037,14 @@ func StringRecordDeltas(batch []map[string]string, deltas []map[string]interface
 	if deltas == nil {
 		deltas = make([]map[string]interface{}, 0, len(batch))
 	}
-	last := make(map[string]string, 20)
+	lasts := make(map[string]map[string]string)
 	for ; pos < len(batch); pos++ {
+		dk := batch[pos][DeviceKeyField]
+		last := lasts[dk]
+		if last == nil {
+			last = make(map[string]string, 20)
+			lasts[dk] = last
+		}
 		var nrec map[string]string
 		if (pos % keyframePeriod) == 0 {
 			nrec = make(map[string]string, len(batch[pos]))
@@ -550,6 +1053,9 @@ func StringRecordDeltas(batch []map[string]string, deltas []map[string]interface
 			}
 		} else {
 			nrec = stringRecDiff(last, batch[pos])
+			if dk != "" {
+				nrec[DeviceKeyField] = dk
+			}
 		}
 		deltas = append(deltas, ParseRecord(nrec))
 		for k, v := range batch[pos] {
@@ -585,13 +1091,23 @@ func parsedRecDiff(a, b map[string]interface{}) map[string]interface{} {
 
 // ParsedRecordDeltas converts records from ParseRecord() into a list of record deltas.
 // The first record has full data and each following record only has fields that changed.
+// Records with a DeviceKeyField are diffed against the previous record from the same device, and keep the device key.
 func ParsedRecordDeltas(alldata []map[string]interface{}) []map[string]interface{} {
 	var alldeltas []map[string]interface{} = nil
-	last := make(map[string]interface{}, 20)
+	lasts := make(map[interface{}]map[string]interface{})
 	if len(alldata) > 0 {
 		alldeltas = make([]map[string]interface{}, 0, len(alldata))
 		for i := 0; i < len(alldata); i++ {
+			dk, hasKey := alldata[i][DeviceKeyField]
+			last := lasts[dk]
+			if last == nil {
+				last = make(map[string]interface{}, 20)
+				lasts[dk] = last
+			}
 			nrec := parsedRecDiff(last, alldata[i])
+			if hasKey {
+				nrec[DeviceKeyField] = dk
+			}
 			alldeltas = append(alldeltas, nrec)
 			for k, v := range alldata[i] {
 				last[k] = v
@@ -603,8 +1119,14 @@ func ParsedRecordDeltas(alldata []map[string]interface{}) []map[string]interface
 
 // Convert *in-place* deltas into whole records
 func ParsedRecordRebuild(deltas []map[string]interface{}) {
-	cv := make(map[string]interface{}, 20)
+	cvs := make(map[interface{}]map[string]interface{})
 	for i, rec := range deltas {
+		dk := rec[DeviceKeyField]
+		cv := cvs[dk]
+		if cv == nil {
+			cv = make(map[string]interface{}, 20)
+			cvs[dk] = cv
+		}
 		for k, v := range rec {
 			cv[k] = v
 		}
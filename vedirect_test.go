@@ -1,8 +1,14 @@
 package vedirect
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"io"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestInit(t *testing.T) {
@@ -26,6 +32,7 @@ var wuCases = []wholeUnitsCase{
 	{37, "farts", 37.0, "farts"},
 	{10_000, "mAh", 10.0, "Ah"},
 	{37, "", 37.0, ""},
+	{5, "min", 5.0, "min"},
 	{10_0, "0.1A", 10.0, "A"},
 	{10_00, "0.01kWh", 10.0, "kWh"},
 	{10_00, "0.01V", 10.0, "V"},
@@ -114,3 +121,247 @@ func TestStringRecordDeltas(t *testing.T) {
 		}
 	}
 }
+
+func TestStringRecordDeltasDevices(t *testing.T) {
+	jsons := []string{
+		`{"_d":"HQ1","V":"1","_t":"1"}`,
+		`{"_d":"HQ2","V":"1","_t":"2"}`,
+		`{"_d":"HQ1","V":"1","_t":"3"}`,
+		`{"_d":"HQ2","V":"2","_t":"4"}`,
+	}
+	expected := []string{
+		"{\"V\":1,\"_d\":\"HQ1\",\"_t\":1}",
+		"{\"V\":1,\"_d\":\"HQ2\",\"_t\":2}",
+		"{\"_d\":\"HQ1\",\"_t\":3}",
+		"{\"V\":2,\"_d\":\"HQ2\",\"_t\":4}",
+	}
+	data := make([]map[string]string, len(jsons))
+	for i, jsoni := range jsons {
+		rec := make(map[string]string)
+		json.Unmarshal([]byte(jsoni), &rec)
+		data[i] = rec
+	}
+	out := StringRecordDeltas(data, nil, 9999)
+	for i, drec := range out {
+		blob, _ := json.Marshal(drec)
+		eq(t, expected[i], string(blob))
+	}
+}
+
+// build a text protocol block with correct Checksum
+func testFrame(kv ...string) []byte {
+	var b bytes.Buffer
+	for i := 0; i+1 < len(kv); i += 2 {
+		b.WriteString("\r\n" + kv[i] + "\t" + kv[i+1])
+	}
+	b.WriteString("\r\nChecksum\t")
+	var sum byte
+	for _, c := range b.Bytes() {
+		sum += c
+	}
+	b.WriteByte(-sum)
+	return b.Bytes()
+}
+
+// in-memory io.ReadWriter
+type testRW struct {
+	io.Reader
+	bytes.Buffer
+}
+
+func (rw *testRW) Read(p []byte) (int, error) {
+	return rw.Reader.Read(p)
+}
+
+func TestNew(t *testing.T) {
+	var stream []byte
+	stream = append(stream, testFrame("PID", "0xA053", "V", "13820")...)
+	stream = append(stream, testFrame("PID", "0xA053", "V", "13830")...)
+	rw := &testRW{Reader: bytes.NewReader(stream)}
+	out := make(chan map[string]string, 10)
+	v := New(rw, out, Options{})
+	err := v.SendHexCommand(Get, []byte{0xf0, 0xed, 0x00})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recs []map[string]string
+	for rec := range out {
+		recs = append(recs, rec)
+	}
+	eq(t, 2, len(recs))
+	eq(t, "13830", recs[1]["V"])
+	eq(t, ":7F0ED0071\n", rw.Buffer.String())
+
+	ro := NewReader(bytes.NewReader(stream), make(chan map[string]string, 10), Options{})
+	eq(t, ErrNoOutput, ro.SendHexCommand(Get, []byte{0xf0, 0xed, 0x00}))
+}
+
+func TestStatsAndErr(t *testing.T) {
+	var stream []byte
+	stream = append(stream, testFrame("PID", "0xA053", "V", "13820")...)
+	bad := testFrame("PID", "0xA053", "V", "13830")
+	bad[len(bad)-1]++
+	stream = append(stream, bad...)
+	stream = append(stream, []byte(":7F0ED0071\n")...)
+	stream = append(stream, []byte(":7F0ED0072\n")...)
+	stream = append(stream, testFrame("PID", "0xA053", "V", "13840")...)
+	out := make(chan map[string]string, 10)
+	v := NewReader(bytes.NewReader(stream), out, Options{})
+	var recs []map[string]string
+	for rec := range out {
+		recs = append(recs, rec)
+	}
+	<-v.Done()
+	eq(t, io.EOF, v.Err())
+	eq(t, 3, len(recs))
+	eq(t, "13840", recs[2]["V"])
+	st := v.Stats()
+	eq(t, int64(len(stream)), st.BytesRead)
+	eq(t, int64(2), st.Frames)
+	eq(t, int64(1), st.ChecksumErrors)
+	eq(t, int64(1), st.HexFrames)
+	eq(t, int64(1), st.HexErrors)
+	if st.LastFrame.IsZero() {
+		t.Error("LastFrame not set")
+	}
+}
+
+var errTestUnplugged = errors.New("unplugged")
+
+type failingReader struct {
+	io.Reader
+}
+
+func (fr failingReader) Read(p []byte) (int, error) {
+	n, err := fr.Reader.Read(p)
+	if err == io.EOF {
+		err = errTestUnplugged
+	}
+	return n, err
+}
+
+func TestReconnect(t *testing.T) {
+	oldWait := reconnectMinWait
+	t.Cleanup(func() { reconnectMinWait = oldWait })
+	reconnectMinWait = time.Millisecond
+	out := make(chan map[string]string, 10)
+	ctx, cf := context.WithCancel(context.Background())
+	v := newVedirect(out, Options{Reconnect: true, Context: ctx})
+	opens := 0
+	v.reopen = func() (io.ReadWriter, error) {
+		opens++
+		switch opens {
+		case 1:
+			return nil, errTestUnplugged
+		case 2:
+			return &testRW{Reader: bytes.NewReader(testFrame("V", "13000"))}, nil
+		default:
+			cf()
+			return nil, errTestUnplugged
+		}
+	}
+	v.setPort(&testRW{Reader: failingReader{bytes.NewReader(testFrame("V", "12000"))}})
+	v.start()
+	var recs []map[string]string
+	for rec := range out {
+		recs = append(recs, rec)
+	}
+	eq(t, 6, len(recs))
+	eq(t, "connected", recs[0]["_c"])
+	eq(t, "12000", recs[1]["V"])
+	eq(t, "lost", recs[2]["_c"])
+	eq(t, "reconnected", recs[3]["_c"])
+	eq(t, "13000", recs[4]["V"])
+	eq(t, "lost", recs[5]["_c"])
+	eq(t, context.Canceled, v.Err())
+	eq(t, int64(1), v.Stats().Reconnects)
+}
+
+type pipeRW struct {
+	*io.PipeReader
+	io.Writer
+}
+
+type closeRecorder struct {
+	io.Reader
+	io.Writer
+	// times Close was called
+	closed int32
+}
+
+func (c *closeRecorder) Close() error {
+	atomic.AddInt32(&c.closed, 1)
+	return nil
+}
+
+func TestPortClosedOnExit(t *testing.T) {
+	port := &closeRecorder{Reader: bytes.NewReader(testFrame("V", "12000")), Writer: io.Discard}
+	out := make(chan map[string]string, 10)
+	New(port, out, Options{})
+	for range out {
+	}
+	// interruptThread also wakes up on exit, give it a chance to close again
+	time.Sleep(20 * time.Millisecond)
+	eq(t, int32(1), atomic.LoadInt32(&port.closed))
+}
+
+func TestCloseBlockedRead(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	out := make(chan map[string]string) // unbuffered and never read
+	v := New(&pipeRW{pr, io.Discard}, out, Options{})
+	go pw.Write(testFrame("V", "12000"))
+	closed := make(chan error)
+	go func() {
+		closed <- v.Close()
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close() did not return")
+	}
+	eq(t, context.Canceled, v.Err())
+	_, ok := <-out
+	eq(t, false, ok)
+
+	// cancel Context of a silent device
+	pr, pw = io.Pipe()
+	defer pw.Close()
+	ctx, cf := context.WithCancel(context.Background())
+	out = make(chan map[string]string, 1)
+	v = New(&pipeRW{pr, io.Discard}, out, Options{Context: ctx})
+	cf()
+	select {
+	case <-v.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancel did not stop read thread")
+	}
+	eq(t, context.Canceled, v.Err())
+}
+
+func TestMergeBlocks(t *testing.T) {
+	var stream []byte
+	// BMV-712: live block then history block
+	stream = append(stream, testFrame("PID", "0xA381", "V", "12800", "SOC", "1000")...)
+	stream = append(stream, testFrame("H1", "-5000", "H2", "-100")...)
+	stream = append(stream, testFrame("PID", "0xA381", "V", "12810", "SOC", "999")...)
+	stream = append(stream, testFrame("H1", "-5000", "H2", "-110")...)
+	// single block MPPT passes through
+	stream = append(stream, testFrame("PID", "0xA053", "V", "13820")...)
+	// BMV first block without its history at end of stream
+	stream = append(stream, testFrame("PID", "0xA381", "V", "12820", "SOC", "998")...)
+	out := make(chan map[string]string, 10)
+	NewReader(bytes.NewReader(stream), out, Options{MergeBlocks: true, AddTime: true})
+	var recs []map[string]string
+	for rec := range out {
+		recs = append(recs, rec)
+	}
+	eq(t, 4, len(recs))
+	eq(t, "12800", recs[0]["V"])
+	eq(t, "-100", recs[0]["H2"])
+	eq(t, 6, len(recs[0])) // PID V SOC H1 H2 _t
+	eq(t, "-110", recs[1]["H2"])
+	eq(t, "0xA053", recs[2]["PID"])
+	eq(t, "", recs[2]["H2"])
+	eq(t, "998", recs[3]["SOC"])
+}
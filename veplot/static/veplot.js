@@ -9,8 +9,9 @@ var plottables = {
   "AC_OUT_V": {"n":"AC Volts", "u":"V","m":0.01,"d":5},
   "AC_OUT_I": {"n":"AC Amps", "u":"A","m":0.1,"d":5},
   "AC_OUT_S": {"n":"AC Power", "u":"VA","d":5},
-  "battery temperature": {"n":"battery temperature", "u":"°C", "m":0.01, "offset": -273.15, "d":2},
-  "charger internal temperature": {"n":"charger temperature", "u":"°C", "m":0.01, "d":2}
+  // "reg" values are HEX registers, already scaled when the server sends "eng":true
+  "battery temperature": {"n":"battery temperature", "u":"°C", "m":0.01, "offset": -273.15, "d":2, "reg":true},
+  "charger internal temperature": {"n":"charger temperature", "u":"°C", "m":0.01, "d":2, "reg":true}
 };
 var numberStats = {
   "H20": {"n":"Yield today","u":"kWh","m":0.01,"d":3},
@@ -115,14 +116,15 @@ window.bve.plotResponse = function(ob, elemid, veopt) {
       if (plottables[varname]["u"]) {
 	nicename += " (" + plottables[varname]["u"] + ")";
       }
+      var scaled = ob.eng && plottables[varname]["reg"];
       var multiplier = plottables[varname]["m"];
-      if (multiplier) {
+      if (multiplier && !scaled) {
 	for(var i = 1; i < xy.length; i += 2){
 	  xy[i] = xy[i] * multiplier;
 	}
       }
       var offset = plottables[varname]["offset"];
-      if (offset) {
+      if (offset && !scaled) {
 	for(var i = 1; i < xy.length; i += 2){
 	  xy[i] = xy[i] + offset;
 	}
@@ -0,0 +1,71 @@
+package vesim
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Pty is a pseudo-terminal. The simulator reads and writes the controlling side, clients open Path.
+type Pty struct {
+	*os.File
+	Path string
+
+	// kept open so reads don't fail with EIO while no client has Path open
+	client *os.File
+}
+
+// OpenPty opens a new pseudo-terminal in raw mode
+func OpenPty() (*Pty, error) {
+	ptmx, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+	fd := int(ptmx.Fd())
+	err = unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0)
+	if err != nil {
+		ptmx.Close()
+		return nil, fmt.Errorf("pty unlock, %w", err)
+	}
+	n, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	if err != nil {
+		ptmx.Close()
+		return nil, fmt.Errorf("pty number, %w", err)
+	}
+	path := fmt.Sprintf("/dev/pts/%d", n)
+	client, err := os.OpenFile(path, os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		ptmx.Close()
+		return nil, err
+	}
+	err = makeRaw(int(client.Fd()))
+	if err != nil {
+		client.Close()
+		ptmx.Close()
+		return nil, fmt.Errorf("%s: raw mode, %w", path, err)
+	}
+	return &Pty{File: ptmx, Path: path, client: client}, nil
+}
+
+// no echo or CR/LF translation, like a serial port
+func makeRaw(fd int) error {
+	tio, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return err
+	}
+	tio.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	tio.Oflag &^= unix.OPOST
+	tio.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	tio.Cflag &^= unix.CSIZE | unix.PARENB
+	tio.Cflag |= unix.CS8
+	tio.Cc[unix.VMIN] = 1
+	tio.Cc[unix.VTIME] = 0
+	return unix.IoctlSetTermios(fd, unix.TCSETS, tio)
+}
+
+// Close both sides
+func (p *Pty) Close() error {
+	p.client.Close()
+	return p.File.Close()
+}
@@ -0,0 +1,40 @@
+package vesim
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/brianolson/vedirect"
+)
+
+func TestPty(t *testing.T) {
+	pty, err := OpenPty()
+	if err != nil {
+		t.Skipf("no pty, %v", err)
+	}
+	defer pty.Close()
+	dev := NewDevice(MPPT)
+	dev.Interval = 20 * time.Millisecond
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	go dev.Run(ctx, pty)
+
+	out := make(chan map[string]string, 10)
+	v, err := vedirect.OpenWithOptions(pty.Path, out, vedirect.Options{Context: ctx})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	select {
+	case rec := <-out:
+		eq(t, "0xA053", rec["PID"])
+	case <-time.After(5 * time.Second):
+		t.Fatal("no record from pty")
+	}
+	fv, err := v.Ping(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq(t, vedirect.FirmwareVersion(0x4159), fv)
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package vesim
+
+import (
+	"errors"
+	"os"
+)
+
+// Pty is a pseudo-terminal. The simulator reads and writes the controlling side, clients open Path.
+type Pty struct {
+	*os.File
+	Path string
+}
+
+var ErrNoPty = errors.New("vesim pseudo-terminal only supported on linux")
+
+// OpenPty is only supported on linux
+func OpenPty() (*Pty, error) {
+	return nil, ErrNoPty
+}
@@ -0,0 +1,150 @@
+package vesim
+
+import (
+	"time"
+
+	"github.com/brianolson/vedirect"
+)
+
+// State is the simulated electrical state, in whole units.
+// Each device Kind reports the parts of it that that kind of device measures.
+type State struct {
+	BatteryVoltage float64 // V
+	BatteryCurrent float64 // A into the battery from the charger
+	LoadCurrent    float64 // A out of the battery
+	PanelVoltage   float64 // V
+	PanelPower     float64 // W
+	SOC            float64 // %
+	Temperature    float64 // °C inside the device
+
+	ChargeState vedirect.ChargeState
+	TrackerMode vedirect.TrackerMode
+	Error       vedirect.ErrorCode
+	OffReason   vedirect.OffReason
+	Alarm       vedirect.AlarmReason
+
+	ACOutVoltage float64 // V
+	ACOutCurrent float64 // A
+
+	// accumulated by Device.Step
+	YieldToday    float64 // kWh
+	YieldTotal    float64 // kWh
+	MaxPowerToday float64 // W
+	ConsumedAh    float64 // Ah, negative
+}
+
+// Scenario sets State for the simulated time since the simulation started.
+type Scenario func(at time.Duration, s *State)
+
+// Scenarios by name, for command line flags
+var Scenarios = map[string]Scenario{
+	"steady":       Steady,
+	"sunrise":      Sunrise,
+	"battery-full": BatteryFull,
+	"error":        ErrorCodes,
+}
+
+const (
+	absorptionVoltage = 14.4
+	floatVoltage      = 13.8
+)
+
+// values common to all scenarios
+func base(s *State) {
+	s.Temperature = 25
+	s.LoadCurrent = 0.5
+	s.ACOutVoltage = 230
+	s.ACOutCurrent = 0.4
+	s.Error = 0
+	s.OffReason = 0
+	s.Alarm = 0
+}
+
+// Steady is a sunny day with the battery in bulk charge
+func Steady(at time.Duration, s *State) {
+	base(s)
+	s.PanelVoltage = 38
+	s.PanelPower = 120
+	s.BatteryVoltage = 13.2
+	s.BatteryCurrent = s.PanelPower / s.BatteryVoltage
+	s.SOC = 80
+	s.ChargeState = 3 // Bulk
+	s.TrackerMode = 2 // MPP Tracker active
+}
+
+// Sunrise ramps panel power from nothing to 200 W over an hour.
+// The charger goes from off to bulk, then to absorption when the battery reaches 14.4 V.
+func Sunrise(at time.Duration, s *State) {
+	base(s)
+	frac := float64(at) / float64(time.Hour)
+	if frac > 1 {
+		frac = 1
+	}
+	s.PanelPower = 200 * frac
+	s.BatteryVoltage = 12.3 + (absorptionVoltage-12.3)*frac
+	s.SOC = 40 + 50*frac
+	if s.PanelPower < 1 {
+		s.PanelVoltage = 0
+		s.PanelPower = 0
+		s.BatteryCurrent = 0
+		s.ChargeState = 0 // Off
+		s.TrackerMode = 0
+		s.OffReason = 1 // No input power
+		return
+	}
+	s.PanelVoltage = 18 + 20*frac
+	s.BatteryCurrent = s.PanelPower / s.BatteryVoltage
+	if s.BatteryVoltage >= absorptionVoltage {
+		s.ChargeState = 4 // Absorption
+		s.TrackerMode = 1 // Voltage or current limited
+	} else {
+		s.ChargeState = 3 // Bulk
+		s.TrackerMode = 2
+	}
+}
+
+// BatteryFull holds a full battery at float voltage
+func BatteryFull(at time.Duration, s *State) {
+	base(s)
+	s.PanelVoltage = 40
+	s.PanelPower = 12
+	s.BatteryVoltage = floatVoltage
+	s.BatteryCurrent = s.PanelPower / s.BatteryVoltage
+	s.SOC = 100
+	s.ChargeState = 5 // Float
+	s.TrackerMode = 1
+}
+
+// errorCycle is stepped through once a minute by ErrorCodes
+var errorCycle = []vedirect.ErrorCode{
+	0,
+	2,  // Battery voltage too high
+	17, // Charger temperature too high
+	33, // Input voltage too high (solar panel)
+	0,
+	18, // Charger over current
+}
+
+// ErrorCodes is Steady, but changes error code every minute.
+// While in error the charger is in Fault and stops charging.
+func ErrorCodes(at time.Duration, s *State) {
+	Steady(at, s)
+	s.Error = errorCycle[int(at/time.Minute)%len(errorCycle)]
+	if s.Error == 0 {
+		return
+	}
+	s.ChargeState = 2 // Fault
+	s.TrackerMode = 0
+	s.BatteryCurrent = 0
+	s.PanelPower = 0
+	switch s.Error {
+	case 2:
+		s.BatteryVoltage = 15.9
+		s.Alarm = 2 // High Voltage
+	case 17:
+		s.Temperature = 85
+		s.Alarm = 64 // High Temperature
+	case 33:
+		s.PanelVoltage = 105
+	}
+}
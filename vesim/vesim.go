@@ -0,0 +1,531 @@
+// Package vesim simulates VE.Direct devices for testing without hardware.
+//
+// A Device sends text protocol frames and answers HEX protocol commands
+// over any io.ReadWriter, e.g. a pseudo-terminal from OpenPty or a TCP
+// connection, so the unmodified vedirect parser can read from it.
+package vesim
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	ehex "encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brianolson/vedirect"
+)
+
+// Kind of device to simulate
+type Kind int
+
+const (
+	MPPT Kind = iota
+	BMV
+	Inverter
+)
+
+var kindNames = []string{"mppt", "bmv", "inverter"}
+
+func (k Kind) String() string {
+	if k >= 0 && int(k) < len(kindNames) {
+		return kindNames[k]
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+// ParseKind is the inverse of Kind.String()
+func ParseKind(name string) (Kind, error) {
+	for i, kn := range kindNames {
+		if kn == name {
+			return Kind(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown device kind %#v, want one of %s", name, strings.Join(kindNames, ", "))
+}
+
+// DefaultInterval is the default time between text frames
+const DefaultInterval = time.Second
+
+// Device simulates one VE.Direct device
+type Device struct {
+	Kind     Kind
+	PID      vedirect.ProductID
+	Serial   string
+	Firmware vedirect.FirmwareVersion
+
+	// Interval between text frames, default DefaultInterval
+	Interval time.Duration
+
+	// Speed multiplies simulated time, default 1
+	Speed float64
+
+	// Scenario drives State, default Steady
+	Scenario Scenario
+
+	// AsyncRegister is a u8 register that turns on AsyncUpdates when set non-zero, 0 for none.
+	// The real register depends on the product.
+	AsyncRegister uint16
+
+	// l protects everything below
+	l       sync.Mutex
+	state   State
+	elapsed time.Duration
+	regs    map[uint16][]byte
+	regDefs map[uint16]vedirect.VERegister
+
+	// wl serializes writes of frames and HEX replies
+	wl sync.Mutex
+}
+
+// NewDevice returns a Device of kind with registers seeded from the package register tables
+func NewDevice(kind Kind) *Device {
+	d := &Device{
+		Kind:     kind,
+		Firmware: 0x4159,
+		Serial:   "HQ2232SIM01",
+		regs:     make(map[uint16][]byte),
+		regDefs:  make(map[uint16]vedirect.VERegister),
+	}
+	var regs []vedirect.VERegister
+	switch kind {
+	case MPPT:
+		d.PID = 0xA053
+		regs = vedirect.VE_MPPT_Registers()
+	case BMV:
+		d.PID = 0xA381
+		regs = vedirect.VE_BMV_Registers()
+	case Inverter:
+		d.PID = 0xA211
+		regs = vedirect.VE_PhoenixInverter_Registers()
+	}
+	for _, reg := range regs {
+		zero, err := vedirect.EncodeRegisterValue(reg, 0)
+		if err != nil {
+			// unknown type, can't serve it
+			continue
+		}
+		d.regs[reg.Address] = zero
+		d.regDefs[reg.Address] = reg
+	}
+	for addr, value := range settings[kind] {
+		d.setReg(addr, value)
+	}
+	d.step(0)
+	return d
+}
+
+// register values a fresh device starts with, in whole units
+var settings = map[Kind]map[uint16]float64{
+	MPPT: {
+		0xedf7: absorptionVoltage,
+		0xedf6: floatVoltage,
+		0xedf4: 16.2,
+		0xedf0: 15,
+		0xedef: 12,
+		0xedfc: 6,
+		0xedfb: 2,
+		0x0200: 1,
+	},
+	BMV: {
+		0x1000: bmvCapacity,
+		0x1001: 13.2,
+		0x1002: 4,
+		0x1004: 95,
+		0x1005: 1.25,
+	},
+	Inverter: {
+		0x0200: 2,
+		0x0230: 230,
+		0x2210: 10.5,
+		0x0320: 11.2,
+		0x0321: 11.8,
+	},
+}
+
+// registers that follow State, in whole units
+var stateRegs = map[Kind]map[uint16]func(s *State) float64{
+	MPPT: {
+		0x0201: func(s *State) float64 { return float64(s.ChargeState) },
+		0x0207: func(s *State) float64 { return float64(s.OffReason) },
+		0xedbb: func(s *State) float64 { return s.PanelVoltage },
+		0xedbc: func(s *State) float64 { return s.PanelPower },
+		0xedbd: func(s *State) float64 { return panelCurrent(s) },
+		0xedb3: func(s *State) float64 { return float64(s.TrackerMode) },
+		0xedd5: func(s *State) float64 { return s.BatteryVoltage },
+		0xedd7: func(s *State) float64 { return s.BatteryCurrent },
+		0xedda: func(s *State) float64 { return float64(s.Error) },
+		0xeddb: func(s *State) float64 { return s.Temperature },
+		0xedec: func(s *State) float64 { return 273.15 + s.Temperature },
+		0xedd2: func(s *State) float64 { return s.MaxPowerToday },
+		0xeddd: func(s *State) float64 { return s.YieldTotal },
+	},
+	BMV: {
+		0xed8d: func(s *State) float64 { return s.BatteryVoltage },
+		0xed8f: func(s *State) float64 { return s.BatteryCurrent - s.LoadCurrent },
+		0xed8e: func(s *State) float64 { return s.BatteryVoltage * (s.BatteryCurrent - s.LoadCurrent) },
+		0xeeff: func(s *State) float64 { return s.ConsumedAh },
+		0x0fff: func(s *State) float64 { return s.SOC },
+		0xedec: func(s *State) float64 { return 273.15 + s.Temperature },
+	},
+	Inverter: {
+		0x0201: func(s *State) float64 { return float64(inverterState(s)) },
+		0x0207: func(s *State) float64 { return float64(s.OffReason) },
+		0x031e: func(s *State) float64 { return float64(s.Alarm) },
+		0x2200: func(s *State) float64 { return s.ACOutVoltage },
+		0x2201: func(s *State) float64 { return s.ACOutCurrent },
+		0x2205: func(s *State) float64 { return s.ACOutVoltage * s.ACOutCurrent },
+		0xed8d: func(s *State) float64 { return s.BatteryVoltage },
+	},
+}
+
+func panelCurrent(s *State) float64 {
+	if s.PanelVoltage <= 0 {
+		return 0
+	}
+	return s.PanelPower / s.PanelVoltage
+}
+
+func inverterState(s *State) vedirect.ChargeState {
+	if s.Error != 0 {
+		return 2 // Fault
+	}
+	return 9 // Inverting
+}
+
+// set a known register from whole units, l must be held
+func (d *Device) setReg(addr uint16, value float64) {
+	reg, ok := d.regDefs[addr]
+	if !ok {
+		return
+	}
+	data, err := vedirect.EncodeRegisterValue(reg, value)
+	if err != nil {
+		return
+	}
+	d.regs[addr] = data
+}
+
+// State returns a copy of the current simulated state
+func (d *Device) State() State {
+	d.l.Lock()
+	defer d.l.Unlock()
+	return d.state
+}
+
+// Step advances simulated time by dt
+func (d *Device) Step(dt time.Duration) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	d.step(dt)
+}
+
+func (d *Device) step(dt time.Duration) {
+	d.elapsed += dt
+	scenario := d.Scenario
+	if scenario == nil {
+		scenario = Steady
+	}
+	scenario(d.elapsed, &d.state)
+	s := &d.state
+	hours := dt.Hours()
+	s.YieldToday += s.PanelPower * hours / 1000
+	s.YieldTotal += s.PanelPower * hours / 1000
+	if s.PanelPower > s.MaxPowerToday {
+		s.MaxPowerToday = s.PanelPower
+	}
+	s.ConsumedAh += (s.BatteryCurrent - s.LoadCurrent) * hours
+	if s.ConsumedAh > 0 {
+		s.ConsumedAh = 0
+	}
+	for addr, f := range stateRegs[d.Kind] {
+		d.setReg(addr, f(s))
+	}
+}
+
+// Frame returns the text protocol block(s) for the current state
+func (d *Device) Frame() []byte {
+	d.l.Lock()
+	defer d.l.Unlock()
+	s := &d.state
+	var out []byte
+	switch d.Kind {
+	case MPPT:
+		out = vedirect.AppendTextBlock(out,
+			"PID", pidString(d.PID),
+			"FW", fwString(d.Firmware),
+			"SER#", d.Serial,
+			"V", milli(s.BatteryVoltage),
+			"I", milli(s.BatteryCurrent),
+			"VPV", milli(s.PanelVoltage),
+			"PPV", whole(s.PanelPower),
+			"CS", strconv.Itoa(int(s.ChargeState)),
+			"MPPT", strconv.Itoa(int(s.TrackerMode)),
+			"OR", fmt.Sprintf("0x%08X", uint32(s.OffReason)),
+			"ERR", strconv.Itoa(int(s.Error)),
+			"LOAD", "ON",
+			"IL", milli(s.LoadCurrent),
+			"H19", centi(s.YieldTotal),
+			"H20", centi(s.YieldToday),
+			"H21", whole(s.MaxPowerToday),
+			"H22", "0",
+			"H23", "0",
+			"HSDS", "0",
+		)
+	case BMV:
+		current := s.BatteryCurrent - s.LoadCurrent
+		ttg := "-1"
+		if current < 0 {
+			ttg = whole(60 * (s.SOC / 100 * bmvCapacity) / -current)
+		}
+		alarm := "OFF"
+		if s.Alarm != 0 {
+			alarm = "ON"
+		}
+		out = vedirect.AppendTextBlock(out,
+			"PID", pidString(d.PID),
+			"V", milli(s.BatteryVoltage),
+			"I", milli(current),
+			"P", whole(s.BatteryVoltage*current),
+			"CE", milli(s.ConsumedAh),
+			"SOC", whole(s.SOC*10),
+			"TTG", ttg,
+			"Alarm", alarm,
+			"Relay", "OFF",
+			"AR", strconv.Itoa(int(s.Alarm)),
+			"BMV", "712 Smart",
+			"FW", fwString(d.Firmware),
+			"MON", "0",
+		)
+		out = vedirect.AppendTextBlock(out,
+			"H1", milli(s.ConsumedAh),
+			"H2", milli(s.ConsumedAh),
+			"H3", "0",
+			"H4", "0",
+			"H5", "0",
+			"H6", milli(s.ConsumedAh),
+			"H7", milli(s.BatteryVoltage),
+			"H8", milli(s.BatteryVoltage),
+			"H9", "0",
+			"H10", "0",
+			"H11", "0",
+			"H12", "0",
+			"H17", "0",
+			"H18", centi(s.YieldTotal),
+		)
+	case Inverter:
+		out = vedirect.AppendTextBlock(out,
+			"PID", pidString(d.PID),
+			"FW", fwString(d.Firmware),
+			"SER#", d.Serial,
+			"MODE", "2",
+			"CS", strconv.Itoa(int(inverterState(s))),
+			"AC_OUT_V", centi(s.ACOutVoltage),
+			"AC_OUT_I", whole(s.ACOutCurrent*10),
+			"AC_OUT_S", whole(s.ACOutVoltage*s.ACOutCurrent),
+			"V", milli(s.BatteryVoltage),
+			"AR", strconv.Itoa(int(s.Alarm)),
+			"WARN", "0",
+			"OR", fmt.Sprintf("0x%08X", uint32(s.OffReason)),
+		)
+	}
+	return out
+}
+
+// AsyncUpdates returns an Async (0xA) HEX message for each register that follows State, if AsyncRegister has been set non-zero.
+// Run sends them after each text frame.
+func (d *Device) AsyncUpdates() []byte {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if !d.asyncOn() {
+		return nil
+	}
+	addrs := make([]int, 0, len(stateRegs[d.Kind]))
+	for addr := range stateRegs[d.Kind] {
+		addrs = append(addrs, int(addr))
+	}
+	sort.Ints(addrs)
+	var out []byte
+	for _, addr := range addrs {
+		value, ok := d.regs[uint16(addr)]
+		if !ok {
+			continue
+		}
+		msg := append([]byte{byte(addr), byte(addr >> 8), 0}, value...)
+		out = append(out, vedirect.EncodeHexMessage(vedirect.HexAsync, msg)...)
+	}
+	return out
+}
+
+// l must be held
+func (d *Device) asyncOn() bool {
+	if d.AsyncRegister == 0 {
+		return false
+	}
+	for _, b := range d.regs[d.AsyncRegister] {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Ah
+const bmvCapacity = 100
+
+func whole(x float64) string {
+	return strconv.FormatInt(int64(math.Round(x)), 10)
+}
+
+func milli(x float64) string {
+	return whole(x * 1000)
+}
+
+func centi(x float64) string {
+	return whole(x * 100)
+}
+
+func pidString(pid vedirect.ProductID) string {
+	return fmt.Sprintf("0x%04X", uint16(pid))
+}
+
+// e.g. 0x4159 "159"
+func fwString(fv vedirect.FirmwareVersion) string {
+	return fmt.Sprintf("%x", fv.Version())
+}
+
+// HandleHex answers one HEX command line (":7F0ED0071", trailing newline optional).
+// Returns nil for commands that have no reply.
+func (d *Device) HandleHex(line []byte) []byte {
+	start := bytes.IndexByte(line, ':')
+	if start < 0 {
+		return nil
+	}
+	line = bytes.TrimRight(line[start:], "\r\n")
+	if len(line) < 2 {
+		return nil
+	}
+	// command is one hex digit, pad to a whole byte
+	hbytes, err := ehex.DecodeString("0" + string(line[1:]))
+	if err != nil || len(hbytes) < 2 {
+		return vedirect.EncodeHexMessage(vedirect.HexError, nil)
+	}
+	var sum byte
+	for _, c := range hbytes {
+		sum += c
+	}
+	if sum != 0x55 {
+		return vedirect.EncodeHexMessage(vedirect.HexError, nil)
+	}
+	cmd := vedirect.Command(hbytes[0])
+	msg := hbytes[1 : len(hbytes)-1]
+	u16 := make([]byte, 2)
+	switch cmd {
+	case vedirect.Ping:
+		binary.LittleEndian.PutUint16(u16, uint16(d.Firmware))
+		return vedirect.EncodeHexMessage(vedirect.HexPing, u16)
+	case vedirect.AppVersion:
+		binary.LittleEndian.PutUint16(u16, uint16(d.Firmware))
+		return vedirect.EncodeHexMessage(vedirect.HexDone, u16)
+	case vedirect.ProductId:
+		binary.LittleEndian.PutUint16(u16, uint16(d.PID))
+		return vedirect.EncodeHexMessage(vedirect.HexDone, u16)
+	case vedirect.Restart:
+		return nil
+	case vedirect.Get, vedirect.Set:
+		if len(msg) < 3 {
+			return vedirect.EncodeHexMessage(vedirect.HexError, nil)
+		}
+		return d.handleRegister(cmd, msg)
+	}
+	return vedirect.EncodeHexMessage(vedirect.HexUnknown, nil)
+}
+
+// Get or Set, msg is [addr lo, addr hi, flags, value...]
+func (d *Device) handleRegister(cmd vedirect.Command, msg []byte) []byte {
+	resp := vedirect.HexResponse(cmd)
+	addr := binary.LittleEndian.Uint16(msg)
+	d.l.Lock()
+	defer d.l.Unlock()
+	value, ok := d.regs[addr]
+	if !ok && addr != 0 && addr == d.AsyncRegister {
+		value, ok = []byte{0}, true
+	}
+	if !ok {
+		return vedirect.EncodeHexMessage(resp, []byte{msg[0], msg[1], 0x01})
+	}
+	if cmd == vedirect.Set {
+		nv := msg[3:]
+		if len(nv) != len(value) {
+			return vedirect.EncodeHexMessage(resp, []byte{msg[0], msg[1], 0x04})
+		}
+		value = append([]byte(nil), nv...)
+		d.regs[addr] = value
+	}
+	return vedirect.EncodeHexMessage(resp, append([]byte{msg[0], msg[1], 0}, value...))
+}
+
+// Run sends a text frame every Interval and answers HEX commands read from rw until ctx is done or a write fails.
+// rw is not closed.
+func (d *Device) Run(ctx context.Context, rw io.ReadWriter) error {
+	go d.readCommands(rw)
+	interval := d.Interval
+	if interval == 0 {
+		interval = DefaultInterval
+	}
+	speed := d.Speed
+	if speed == 0 {
+		speed = 1
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err := d.write(rw, d.Frame())
+		if err != nil {
+			return err
+		}
+		if updates := d.AsyncUpdates(); updates != nil {
+			if err = d.write(rw, updates); err != nil {
+				return err
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			d.Step(time.Duration(float64(interval) * speed))
+		}
+	}
+}
+
+func (d *Device) write(w io.Writer, b []byte) error {
+	d.wl.Lock()
+	defer d.wl.Unlock()
+	_, err := w.Write(b)
+	return err
+}
+
+func (d *Device) readCommands(rw io.ReadWriter) {
+	br := bufio.NewReader(rw)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			reply := d.HandleHex(line)
+			if reply != nil {
+				if d.write(rw, reply) != nil {
+					return
+				}
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package vesim
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/brianolson/vedirect"
+)
+
+func eq(t *testing.T, expected, actual interface{}) {
+	t.Helper()
+	if expected == actual {
+		return
+	}
+	t.Errorf("wanted %#v, got %#v", expected, actual)
+}
+
+// parse frames with the real parser
+func parseFrames(t *testing.T, frames []byte, opts vedirect.Options) []map[string]string {
+	out := make(chan map[string]string, 10)
+	v := vedirect.NewReader(bytes.NewReader(frames), out, opts)
+	var recs []map[string]string
+	for rec := range out {
+		recs = append(recs, rec)
+	}
+	st := v.Stats()
+	eq(t, int64(0), st.ChecksumErrors)
+	return recs
+}
+
+func TestFrames(t *testing.T) {
+	recs := parseFrames(t, NewDevice(MPPT).Frame(), vedirect.Options{})
+	eq(t, 1, len(recs))
+	eq(t, "0xA053", recs[0]["PID"])
+	eq(t, "13200", recs[0]["V"])
+	eq(t, "120", recs[0]["PPV"])
+	eq(t, "3", recs[0]["CS"])
+	eq(t, "159", recs[0]["FW"])
+
+	bmv := NewDevice(BMV).Frame()
+	eq(t, 2, len(parseFrames(t, bmv, vedirect.Options{})))
+	recs = parseFrames(t, bmv, vedirect.Options{MergeBlocks: true})
+	eq(t, 1, len(recs))
+	eq(t, "800", recs[0]["SOC"])
+	eq(t, "13200", recs[0]["H7"])
+
+	recs = parseFrames(t, NewDevice(Inverter).Frame(), vedirect.Options{})
+	eq(t, 1, len(recs))
+	eq(t, "23000", recs[0]["AC_OUT_V"])
+	eq(t, "9", recs[0]["CS"])
+}
+
+func TestScenarios(t *testing.T) {
+	d := NewDevice(MPPT)
+	d.Scenario = Sunrise
+	d.Step(0)
+	eq(t, vedirect.ChargeState(0), d.State().ChargeState)
+	d.Step(30 * time.Minute)
+	eq(t, vedirect.ChargeState(3), d.State().ChargeState)
+	d.Step(30 * time.Minute)
+	eq(t, vedirect.ChargeState(4), d.State().ChargeState)
+	if d.State().YieldToday <= 0 {
+		t.Errorf("no yield after sunrise")
+	}
+
+	d = NewDevice(MPPT)
+	d.Scenario = Scenarios["error"]
+	d.Step(time.Minute)
+	eq(t, vedirect.ErrorCode(2), d.State().Error)
+	eq(t, vedirect.ChargeState(2), d.State().ChargeState)
+	recs := parseFrames(t, d.Frame(), vedirect.Options{})
+	eq(t, "2", recs[0]["ERR"])
+
+	_, err := ParseKind("bmv")
+	eq(t, nil, err)
+	_, err = ParseKind("toaster")
+	eq(t, true, err != nil)
+}
+
+func TestHandleHex(t *testing.T) {
+	d := NewDevice(MPPT)
+	// commands have the same format as responses
+	command := func(cmd vedirect.Command, msg ...byte) []byte {
+		return vedirect.EncodeHexMessage(vedirect.HexResponse(cmd), msg)
+	}
+	eq(t, ":154\n", string(command(vedirect.Ping)))
+	eq(t, ":55941B6\n", string(d.HandleHex(command(vedirect.Ping))))
+	eq(t, string(vedirect.EncodeHexMessage(vedirect.HexError, nil)), string(d.HandleHex([]byte(":7F0ED0072\n"))))
+	eq(t, string(vedirect.EncodeHexMessage(vedirect.HexUnknown, nil)), string(d.HandleHex(command(2))))
+	eq(t, string(vedirect.EncodeHexMessage(vedirect.HexGet, []byte{0xf0, 0xed, 0, 0x96, 0})), string(d.HandleHex(command(vedirect.Get, 0xf0, 0xed, 0))))
+	eq(t, string(vedirect.EncodeHexMessage(vedirect.HexGet, []byte{0x34, 0x12, 0x01})), string(d.HandleHex(command(vedirect.Get, 0x34, 0x12, 0))))
+	eq(t, string(vedirect.EncodeHexMessage(vedirect.HexSet, []byte{0xf0, 0xed, 0x04})), string(d.HandleHex(command(vedirect.Set, 0xf0, 0xed, 0, 1))))
+	eq(t, true, d.HandleHex([]byte("\r\n")) == nil)
+
+	// BMV state of charge, 80.00%
+	bmv := NewDevice(BMV)
+	eq(t, string(vedirect.EncodeHexMessage(vedirect.HexGet, []byte{0xff, 0x0f, 0, 0x40, 0x1f})), string(bmv.HandleHex(command(vedirect.Get, 0xff, 0x0f, 0))))
+}
+
+func TestRun(t *testing.T) {
+	dev := NewDevice(MPPT)
+	dev.Interval = 10 * time.Millisecond
+	devSide, client := net.Pipe()
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	go dev.Run(ctx, devSide)
+
+	out := make(chan map[string]string, 10)
+	v := vedirect.New(client, out, vedirect.Options{HexTimeout: time.Second})
+	defer v.Close()
+	go func() {
+		for range out {
+		}
+	}()
+
+	fv, err := v.Ping(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq(t, vedirect.FirmwareVersion(0x4159), fv)
+	p, err := v.ProductID(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq(t, "SmartSolar MPPT 75|15", p.Name)
+	rv, err := v.GetRegister(ctx, 0xedf7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq(t, uint16(1440), rv.Value)
+	rv, err = v.SetRegister(ctx, rv.Register, 14.2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq(t, uint16(1420), rv.Value)
+	rv, err = v.GetRegister(ctx, 0xedf7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq(t, uint16(1420), rv.Value)
+	if v.Stats().Frames == 0 {
+		t.Error("no text frames received")
+	}
+}
+
+func TestAsyncUpdates(t *testing.T) {
+	dev := NewDevice(MPPT)
+	dev.Interval = 10 * time.Millisecond
+	dev.AsyncRegister = 0xF0F0
+	eq(t, true, dev.AsyncUpdates() == nil)
+	devSide, client := net.Pipe()
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	go dev.Run(ctx, devSide)
+
+	out := make(chan map[string]string, 10)
+	asyncReg := vedirect.VERegister{Address: 0xF0F0, Name: "async updates", Size: vedirect.RegType_u8}
+	v := vedirect.New(client, out, vedirect.Options{HexTimeout: time.Second, AsyncUpdatesRegister: &asyncReg})
+	defer v.Close()
+	go func() {
+		for range out {
+		}
+	}()
+	updates := make(chan vedirect.RegisterUpdate, 100)
+	v.SubscribeAll(updates)
+
+	err := v.SetAsyncUpdates(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case u := <-updates:
+		_, ok := stateRegs[MPPT][u.Register.Address]
+		eq(t, true, ok)
+	case <-time.After(2 * time.Second):
+		t.Fatal("no async update")
+	}
+}
+
+// corrupts the checksum of HEX commands on their way to the device
+type corruptConn struct {
+	net.Conn
+}
+
+func (c corruptConn) Write(p []byte) (int, error) {
+	bad := append([]byte(nil), p...)
+	if len(bad) > 3 && bad[0] == ':' {
+		bad[len(bad)-2] ^= 1
+	}
+	return c.Conn.Write(bad)
+}
+
+func TestFramingError(t *testing.T) {
+	dev := NewDevice(MPPT)
+	devSide, client := net.Pipe()
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	go dev.Run(ctx, devSide)
+
+	out := make(chan map[string]string, 10)
+	v := vedirect.New(corruptConn{client}, out, vedirect.Options{HexTimeout: 5 * time.Second})
+	defer v.Close()
+	go func() {
+		for range out {
+		}
+	}()
+	start := time.Now()
+	_, err := v.Ping(ctx)
+	eq(t, vedirect.ErrHexFraming, err)
+	_, err = v.GetRegister(ctx, 0xedf7)
+	eq(t, vedirect.ErrHexFraming, err)
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("framing error took %s, waited for timeout", time.Since(start))
+	}
+}